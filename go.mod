@@ -7,4 +7,5 @@ require (
 	github.com/deckarep/golang-set v1.7.1
 	github.com/miekg/dns v1.1.29
 	github.com/sirupsen/logrus v1.6.0
+	golang.org/x/net v0.0.0-20210428140749-89ef3d95e781
 )
@@ -0,0 +1,226 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/dnsengine"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/massdns"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/native"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/options"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/parser"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/ratelimit"
+)
+
+/*
+Backend resolves the input domains and publishes their DNS records. Runner doesn't care how
+records are obtained, which allows swapping massdns with other sources.
+*/
+type Backend interface {
+	// Start starts publishing records on the channel `c` in background. Implementations
+	// must close the channel once there are no more records or ctx is done.
+	Start(ctx context.Context, c chan<- common.DomainRecords) error
+	// Err returns the error which stopped the backend from publishing all the records, nil
+	// otherwise. It must be called only after the channel is closed.
+	Err() error
+}
+
+/*
+backgroundError holds the error reported on a channel by a task running in background
+*/
+type backgroundError struct {
+	errChan <-chan error
+	once    sync.Once
+	err     error
+}
+
+/*
+get waits for the error from the task. nil is returned if the task was never started.
+*/
+func (e *backgroundError) get() error {
+	e.once.Do(func() {
+		if e.errChan != nil {
+			e.err = <-e.errChan
+		}
+	})
+
+	return e.err
+}
+
+/*
+writeResolversToFile writes the resolvers to a new temporary file, one per line, and returns its path
+*/
+func writeResolversToFile(resolvers common.DNSServers) (string, error) {
+	filePtr, err := ioutil.TempFile("", "dns-wildcard-removal-resolvers-*")
+	if err != nil {
+		return "", err
+	}
+
+	defer filePtr.Close()
+
+	for _, resolver := range resolvers {
+		_, err = filePtr.WriteString(resolver + "\n")
+		if err != nil {
+			os.Remove(filePtr.Name())
+			return "", err
+		}
+	}
+
+	return filePtr.Name(), nil
+}
+
+/*
+removeFileWhenDone removes the file once the task reporting on errChan is done. The returned channel
+receives the error of the task after the file is removed.
+*/
+func removeFileWhenDone(path string, errChan <-chan error) <-chan error {
+	returnChan := make(chan error, 1)
+
+	go func() {
+		err := <-errChan
+		os.Remove(path)
+		returnChan <- err
+	}()
+
+	return returnChan
+}
+
+/*
+MassdnsBackend resolves the input domains using massdns process and parser
+*/
+type MassdnsBackend struct {
+	InputFile    string
+	ResolverFile string
+	// Resolvers are written to a temporary file used instead of ResolverFile if set. The file is
+	// removed once massdns is done
+	Resolvers common.DNSServers
+	Limiter   *ratelimit.Limiter
+	err       backgroundError
+}
+
+/*
+Start starts the massdns process and parser in background
+*/
+func (b *MassdnsBackend) Start(ctx context.Context, c chan<- common.DomainRecords) error {
+	resolverFile := b.ResolverFile
+
+	if b.Resolvers != nil {
+		var err error
+
+		resolverFile, err = writeResolversToFile(b.Resolvers)
+		if err != nil {
+			return err
+		}
+	}
+
+	massdnsOutputPipe, err := massdns.StartMassdnsProcess(ctx, b.InputFile, resolverFile, b.Limiter)
+	if err != nil {
+		if b.Resolvers != nil {
+			os.Remove(resolverFile)
+		}
+
+		return err
+	}
+
+	b.err.errChan = parser.ParseAndPublishDNSRecords(ctx, massdnsOutputPipe, c)
+
+	// Parser is done once massdns exits or is killed
+	if b.Resolvers != nil {
+		b.err.errChan = removeFileWhenDone(resolverFile, b.err.errChan)
+	}
+
+	return nil
+}
+
+/*
+Err returns the error reported by massdns or parser
+*/
+func (b *MassdnsBackend) Err() error {
+	return b.err.get()
+}
+
+/*
+NativeBackend resolves the input domains using native resolver built on dnsengine
+*/
+type NativeBackend struct {
+	InputFile   string
+	Client      *dnsengine.Client
+	Concurrency int
+	err         backgroundError
+}
+
+/*
+Start starts the native resolver in background
+*/
+func (b *NativeBackend) Start(ctx context.Context, c chan<- common.DomainRecords) error {
+	errChan, err := native.StartNativeResolver(ctx, b.InputFile, b.Client, b.Concurrency, c)
+	if err != nil {
+		return err
+	}
+
+	b.err.errChan = errChan
+
+	return nil
+}
+
+/*
+Err returns the error encountered while reading the input
+*/
+func (b *NativeBackend) Err() error {
+	return b.err.get()
+}
+
+/*
+FileBackend reads pre-resolved records from a file containing massdns output(-o Snl or -o Snlt with TTL)
+*/
+type FileBackend struct {
+	InputFile string
+	err       backgroundError
+}
+
+/*
+Start starts the parser on the file in background
+*/
+func (b *FileBackend) Start(ctx context.Context, c chan<- common.DomainRecords) error {
+	fileObj, err := common.GetInputFile(b.InputFile)
+	if err != nil {
+		return err
+	}
+
+	b.err.errChan = parser.ParseAndPublishDNSRecords(ctx, fileObj, c)
+
+	return nil
+}
+
+/*
+Err returns the error reported by parser
+*/
+func (b *FileBackend) Err() error {
+	return b.err.get()
+}
+
+/*
+CreateBackendFromOptions returns the Backend selected by args.Backend. client is used by
+backends which resolve the domains themselves.
+*/
+func CreateBackendFromOptions(args options.Options, client *dnsengine.Client) (Backend, error) {
+	switch args.Backend {
+	case options.BackendMassdns:
+		return &MassdnsBackend{
+			InputFile:    args.Input,
+			ResolverFile: args.ResolverFile,
+			Resolvers:    args.MassdnsResolvers,
+			Limiter:      args.QueryConfig.Limiter,
+		}, nil
+	case options.BackendNative:
+		return &NativeBackend{InputFile: args.Input, Client: client, Concurrency: args.Concurrency}, nil
+	case options.BackendFile:
+		return &FileBackend{InputFile: args.Input}, nil
+	}
+
+	return nil, fmt.Errorf("unknown backend: %s", args.Backend)
+}
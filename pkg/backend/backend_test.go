@@ -0,0 +1,175 @@
+package backend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/dnsengine"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/options"
+)
+
+func TestFileBackend_Start(t *testing.T) {
+	inputFile, err := ioutil.TempFile("", "rand0m_tmp_*")
+	if err != nil {
+		t.Errorf("Start(): Encountered error: %v", err)
+		return
+	}
+	defer os.Remove(inputFile.Name())
+
+	expectedRecord := common.DomainRecords{
+		DomainName: "cname.dns-test.faizalhasanwala.me.",
+		Records: common.DNSRecordSet{
+			{
+				Name:  "cname.dns-test.faizalhasanwala.me.",
+				Type:  "CNAME",
+				Value: "a.root-servers.net.",
+			},
+			{
+				Name:  "a.root-servers.net.",
+				Type:  "A",
+				Value: "198.41.0.4",
+			},
+		},
+	}
+
+	_, err = inputFile.Write([]byte(expectedRecord.Records.String() + "\n\n"))
+	if err != nil {
+		t.Errorf("Start(): Encountered error: %v", err)
+		return
+	}
+
+	b := &FileBackend{InputFile: inputFile.Name()}
+	c := make(chan common.DomainRecords)
+
+	if err := b.Start(context.Background(), c); err != nil {
+		t.Errorf("Start() error = %v, wantErr %v", err, false)
+		return
+	}
+
+	got := make([]common.DomainRecords, 0)
+	for data := range c {
+		got = append(got, data)
+	}
+
+	want := []common.DomainRecords{expectedRecord}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Start() got = %v, want %v", got, want)
+	}
+
+	if err := b.Err(); err != nil {
+		t.Errorf("Err() = %v, want %v", err, nil)
+	}
+}
+
+func Test_writeResolversToFile(t *testing.T) {
+	resolvers := common.DNSServers{"1.1.1.1", "8.8.8.8"}
+
+	path, err := writeResolversToFile(resolvers)
+	if err != nil {
+		t.Errorf("writeResolversToFile() error = %v, wantErr %v", err, false)
+		return
+	}
+	defer os.Remove(path)
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Errorf("writeResolversToFile(): Encountered error: %v", err)
+		return
+	}
+
+	want := "1.1.1.1\n8.8.8.8\n"
+
+	if string(got) != want {
+		t.Errorf("writeResolversToFile() wrote = %v, want %v", string(got), want)
+	}
+}
+
+func Test_removeFileWhenDone(t *testing.T) {
+	errChan := make(chan error, 1)
+
+	path, err := writeResolversToFile(common.DNSServers{"1.1.1.1"})
+	if err != nil {
+		t.Errorf("removeFileWhenDone(): Encountered error: %v", err)
+		return
+	}
+	defer os.Remove(path)
+
+	doneChan := removeFileWhenDone(path, errChan)
+
+	// Kept until the task is done
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("removeFileWhenDone() removed the file early: %v", err)
+	}
+
+	errChan <- nil
+
+	if err := <-doneChan; err != nil {
+		t.Errorf("removeFileWhenDone() error = %v, want %v", err, nil)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("removeFileWhenDone() didn't remove the file")
+	}
+}
+
+func TestCreateBackendFromOptions(t *testing.T) {
+	client := dnsengine.CreateClientInstance(common.DNSServers{"1.1.1.1"}, dnsengine.DefaultConfig())
+
+	tests := []struct {
+		name    string
+		backend string
+		want    Backend
+		wantErr bool
+	}{
+		{
+			name:    "massdns",
+			backend: options.BackendMassdns,
+			want:    &MassdnsBackend{InputFile: "-", ResolverFile: "resolvers.txt"},
+			wantErr: false,
+		},
+		{
+			name:    "native",
+			backend: options.BackendNative,
+			want:    &NativeBackend{InputFile: "-", Client: client, Concurrency: 10},
+			wantErr: false,
+		},
+		{
+			name:    "file",
+			backend: options.BackendFile,
+			want:    &FileBackend{InputFile: "-"},
+			wantErr: false,
+		},
+		{
+			name:    "unknown",
+			backend: "xyz",
+			want:    nil,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := options.Options{
+				Input:        "-",
+				Resolver:     common.DNSServers{"1.1.1.1"},
+				ResolverFile: "resolvers.txt",
+				Backend:      tt.backend,
+				Concurrency:  10,
+			}
+
+			got, err := CreateBackendFromOptions(args, client)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CreateBackendFromOptions() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CreateBackendFromOptions() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -35,21 +35,23 @@ Various constants related to DNS record types
 */
 const (
 	TypeA     = "A"
+	TypeAAAA  = "AAAA"
 	TypeNS    = "NS"
 	TypeCNAME = "CNAME"
 )
 
 /*
-DNSRecord represents a complete DNS record(except TTL)
+DNSRecord represents a complete DNS record. TTL is 0 if not known e.g. parsed from output without TTL
 */
 type DNSRecord struct {
-	Name  string
-	Type  RecordTypeType
-	Value RecordValueType
+	Name  string          `json:"name"`
+	Type  RecordTypeType  `json:"type"`
+	Value RecordValueType `json:"value"`
+	TTL   uint32          `json:"ttl,omitempty"`
 }
 
 /*
-String returns string format of DNS record
+String returns string format of DNS record. TTL isn't included
 */
 func (d DNSRecord) String() string {
 	return fmt.Sprintf("%s %s %s", d.Name, d.Type, d.Value)
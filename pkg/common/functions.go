@@ -1,6 +1,8 @@
 package common
 
 import (
+	"fmt"
+	"os"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -30,3 +32,46 @@ func SanitizeDomainName(domainName string) string {
 
 	return lookupName
 }
+
+/*
+GenerateCannotOpenFileError generates an error using predefined template "cannot open file: %s"
+*/
+func GenerateCannotOpenFileError(path string) error {
+	return fmt.Errorf("cannot open file: %s", path)
+}
+
+/*
+CheckIfFileIsOkay performs following checks
+1) File exists
+2) Not a directory
+*/
+func CheckIfFileIsOkay(filePath string) bool {
+	fInfo, err := os.Stat(filePath)
+
+	if os.IsNotExist(err) {
+		return false
+	}
+
+	if fInfo.IsDir() {
+		return false
+	}
+
+	return true
+}
+
+/*
+GetInputFile check the file for given path and
+if valid returns pointer to os.File object for that file. Path "-" is used for stdin
+*/
+func GetInputFile(path string) (*os.File, error) {
+	if path == "-" {
+		return os.Stdin, nil
+	}
+
+	if CheckIfFileIsOkay(path) {
+		fileObj, err := os.Open(path)
+		return fileObj, err
+	}
+	return nil, GenerateCannotOpenFileError(path)
+
+}
@@ -1,6 +1,11 @@
 package common
 
-import "testing"
+import (
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+)
 
 func TestSanitizeDomainName(t *testing.T) {
 	type args struct {
@@ -41,3 +46,152 @@ func TestSanitizeDomainName(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckIfFileIsOkay(t *testing.T) {
+	type args struct {
+		filePath string
+	}
+
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		t.Skip("Skipping in windows")
+	}
+
+	tests := []struct {
+		name string
+		args args
+		want bool
+	}{
+		{
+			name: "Non Existent file/directory",
+			args: args{
+				filePath: "/xyz/abc",
+			},
+			want: false,
+		},
+		{
+			name: "Existent Directory",
+			args: args{
+				filePath: "/",
+			},
+			want: false,
+		},
+		{
+			name: "Existent file",
+			args: args{
+				filePath: "/etc/hosts",
+			},
+			want: true,
+		},
+		{
+			name: "Existent unreadable file",
+			args: args{
+				filePath: "/etc/shadow",
+			},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CheckIfFileIsOkay(tt.args.filePath); got != tt.want {
+				t.Errorf("CheckIfFileIsOkay() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateCannotOpenFileError(t *testing.T) {
+	type args struct {
+		path string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{
+			name: "Any input",
+			args: args{
+				path: "*",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := GenerateCannotOpenFileError(tt.args.path); (err != nil) != tt.wantErr {
+				t.Errorf("GenerateCannotOpenFileError() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetInputFile(t *testing.T) {
+	type args struct {
+		path string
+	}
+
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		t.Skip("Skipping in windows")
+	}
+
+	tests := []struct {
+		name     string
+		args     args
+		wantPath string
+		wantErr  bool
+	}{
+		{
+			name: "Input file: /etc/hosts",
+			args: args{
+				path: "/etc/hosts",
+			},
+			wantPath: "/etc/hosts",
+			wantErr:  false,
+		},
+		{
+			name: "Input file: stdin",
+			args: args{
+				path: "-",
+			},
+			wantPath: "-",
+			wantErr:  false,
+		},
+		{
+			name: "Input file: directory",
+			args: args{
+				path: "/",
+			},
+			wantPath: "/",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetInputFile(tt.args.path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetInputFile() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			var want *os.File
+
+			if tt.wantPath == "-" {
+				want = os.Stdin
+			} else {
+				want, _ = os.Open(tt.wantPath)
+			}
+
+			gotStat, _ := got.Stat()
+			wantStat, _ := want.Stat()
+
+			if !reflect.DeepEqual(gotStat, wantStat) {
+				t.Errorf("GetInputFile() = %v, want %v", gotStat, wantStat)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package dnsengine
+
+import (
+	"time"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/ratelimit"
+)
+
+/*
+Config controls how queries are sent to the resolvers
+*/
+type Config struct {
+	// Timeout for a single query to a single resolver
+	Timeout time.Duration
+	// Retries is the number of times a failed query is retried with next set of resolvers
+	Retries int
+	// Backoff is the delay before first retry. Delay is doubled for each subsequent retry
+	Backoff time.Duration
+	// MaxParallel is the maximum number of resolvers queried in parallel. Zero means no limit
+	MaxParallel int
+	// UDPSize is the UDP buffer size advertised using EDNS0. Zero disables EDNS0
+	UDPSize uint16
+	// Limiter limits all the queries. It can be shared with other clients. Nil means no limit
+	Limiter *ratelimit.Limiter
+	// ResolverLimiters limits the queries to each resolver. Nil means no limit
+	ResolverLimiters *ratelimit.LimiterGroup
+}
+
+/*
+DefaultConfig returns the Config used when none is provided
+*/
+func DefaultConfig() Config {
+	return Config{
+		Timeout:     2 * time.Second,
+		Retries:     2,
+		Backoff:     250 * time.Millisecond,
+		MaxParallel: 10,
+		UDPSize:     1232,
+	}
+}
+
+/*
+getBackoffForAttempt returns the delay before given attempt. First attempt has no delay
+*/
+func (c Config) getBackoffForAttempt(attempt int) time.Duration {
+	if attempt <= 0 {
+		return 0
+	}
+
+	return c.Backoff * time.Duration(1<<uint(attempt-1))
+}
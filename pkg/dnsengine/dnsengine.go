@@ -3,37 +3,56 @@ package dnsengine
 import (
 	"context"
 	"fmt"
-	"net"
+	"net/http"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/ratelimit"
 	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
 )
 
 /*
 resultPair is used to for passing data in channel
 */
 type resultPair struct {
-	res common.DNSRecordSet
+	res Result
 	err error
 }
 
 /*
-dnsClientWithQueryMessage hold pointers to dns.Client and dns.Msg
+dnsClientWithQueryMessage holds the query settings and dns.Msg. One message is used
+for each queried record type
 */
 type dnsClientWithQueryMessage struct {
-	client     *dns.Client
-	msg        *dns.Msg
+	timeout    time.Duration
+	udpSize    uint16
+	httpClient *http.Client
+	limiter    *ratelimit.Limiter
+	pool       *ResolverPool
+	msgs       []*dns.Msg
 	domainName string
 }
 
 /*
-createDNSRecordSetFromAnswer creates a common.DNSRecordSet from dns.Msg.Answer(alias to []RR) structure
+queryTypes are the record types queried for each domain
+*/
+var queryTypes = []uint16{dns.TypeA, dns.TypeAAAA}
+
+/*
+createDNSRecordSetFromAnswer creates a common.DNSRecordSet from dns.Msg.Answer(alias to []RR) structure.
+DNAME records are skipped as the answer carries the CNAME synthesized from them.
 */
 func createDNSRecordSetFromAnswer(answer []dns.RR) (common.DNSRecordSet, error) {
 	dnsRecordsObject := common.DNSRecordSet{}
 
 	for _, record := range answer {
+		if _, ok := record.(*dns.DNAME); ok {
+			continue
+		}
+
 		queryName := common.SanitizeDomainName(record.Header().Name)
 		recordType := dns.Type(record.Header().Rrtype).String()
 		recordValue := ""
@@ -41,6 +60,8 @@ func createDNSRecordSetFromAnswer(answer []dns.RR) (common.DNSRecordSet, error)
 		switch v := record.(type) {
 		case *dns.A:
 			recordValue = v.A.String()
+		case *dns.AAAA:
+			recordValue = v.AAAA.String()
 		case *dns.CNAME:
 			recordValue = common.SanitizeDomainName(v.Target)
 		case *dns.NS:
@@ -51,7 +72,12 @@ func createDNSRecordSetFromAnswer(answer []dns.RR) (common.DNSRecordSet, error)
 			return nil, fmt.Errorf("unknown record type: %v", record)
 		}
 
-		newRecord := common.DNSRecord{Name: queryName, Type: recordType, Value: recordValue}
+		newRecord := common.DNSRecord{
+			Name:  queryName,
+			Type:  recordType,
+			Value: recordValue,
+			TTL:   record.Header().Ttl,
+		}
 		dnsRecordsObject = append(dnsRecordsObject, newRecord)
 	}
 
@@ -60,35 +86,164 @@ func createDNSRecordSetFromAnswer(answer []dns.RR) (common.DNSRecordSet, error)
 }
 
 /*
-resolveWithSingleResolver attempts to query the message m to provides resolver.
+mergeDNSRecordSets appends records of `b` to `a` skipping the ones already present in `a`, ignoring the
+TTL. Replies for A and AAAA queries share the CNAME chain, which should be present only once even if its
+TTL ticked down between the queries.
 */
-func (x *dnsClientWithQueryMessage) resolveWithSingleResolver(resolver common.IPAddressType,
-	valueChan chan<- resultPair, ctx context.Context) {
-	r, _, _ := x.client.Exchange(
-		x.msg,
-		net.JoinHostPort(resolver, "53"),
-	)
+func mergeDNSRecordSets(a common.DNSRecordSet, b common.DNSRecordSet) common.DNSRecordSet {
+	for _, newRecord := range b {
+		present := false
+
+		for _, record := range a {
+			if record.Name == newRecord.Name && record.Type == newRecord.Type && record.Value == newRecord.Value {
+				present = true
+				break
+			}
+		}
+
+		if !present {
+			a = append(a, newRecord)
+		}
+	}
+
+	return a
+}
+
+/*
+waitForRateLimit blocks until a query to the resolver is allowed by both global and per resolver limits.
+Returns ctx.Err() if ctx is done first.
+*/
+func (x *dnsClientWithQueryMessage) waitForRateLimit(ctx context.Context, resolver *resolverHealth) error {
+	if err := x.limiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	return resolver.limiter.Wait(ctx)
+}
+
+/*
+exchangeOverNetwork sends the message to address over network using dns.Client.ExchangeContext, bounded
+by the Timeout. A new dns.Client is used for each query as ExchangeContext modifies the client. The
+query isn't aborted if ctx is cancelled, so a query to a dead resolver ends with a timeout.
+*/
+func (x *dnsClientWithQueryMessage) exchangeOverNetwork(ctx context.Context, network string, msg *dns.Msg,
+	address string) (*dns.Msg, time.Duration, error) {
+	if x.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, x.timeout)
+		defer cancel()
+	}
+
+	client := &dns.Client{Net: network, Timeout: x.timeout, UDPSize: x.udpSize}
+
+	return client.ExchangeContext(ctx, msg, address)
+}
+
+/*
+exchange sends the message to resolver over the resolver's network and returns the reply. Truncated
+UDP replies are retried over TCP, as partial answer would lead to incomplete record sets.
+*/
+func (x *dnsClientWithQueryMessage) exchange(ctx context.Context, msg *dns.Msg,
+	resolver *resolverHealth) (*dns.Msg, time.Duration, error) {
+	// Packing a message modifies its EDNS0 record. Use a copy as msg is shared by all the resolvers
+	msg = msg.Copy()
+
+	if err := x.waitForRateLimit(ctx, resolver); err != nil {
+		return nil, 0, err
+	}
+
+	if resolver.network == NetworkHTTPS {
+		return exchangeOverHTTPS(ctx, x.httpClient, msg, resolver.address)
+	}
+
+	r, rtt, err := x.exchangeOverNetwork(ctx, resolver.network, msg, resolver.address)
+
+	if r != nil && r.Truncated && resolver.network == NetworkUDP {
+		var tcpRtt time.Duration
+
+		if err := x.waitForRateLimit(ctx, resolver); err != nil {
+			return nil, rtt, err
+		}
+
+		r, tcpRtt, err = x.exchangeOverNetwork(ctx, NetworkTCP, msg, resolver.address)
+		rtt += tcpRtt
+	}
 
+	return r, rtt, err
+}
+
+/*
+resolveWithSingleResolver attempts to query all the messages to provided resolver. Result
+is failure if any of the messages fails. Outcome of each query is recorded in the pool, except the
+ones cancelled before reaching the resolver. Queries in flight when another resolver replies still
+run until reply or timeout, so the dead resolvers of a mostly healthy pool are quarantined too.
+*/
+func (x *dnsClientWithQueryMessage) resolveWithSingleResolver(resolver *resolverHealth,
+	valueChan chan<- resultPair, ctx context.Context) {
 	var result resultPair
 
-	if r == nil {
-		result = resultPair{
-			res: nil,
-			err: fmt.Errorf("failed to resolve: %s", x.domainName),
+	for i, msg := range x.msgs {
+		r, rtt, err := x.exchange(ctx, msg, resolver)
+
+		if r == nil {
+			// Another resolver replied or the query was cancelled before reaching the resolver. Not a
+			// fault of this resolver
+			if err == context.Canceled || err == context.DeadlineExceeded {
+				return
+			}
+
+			if isTimeoutError(err) {
+				x.pool.record(resolver, outcomeTimeout, rtt)
+			} else {
+				x.pool.record(resolver, outcomeFailure, rtt)
+			}
+
+			result = resultPair{
+				res: Result{Status: StatusUnknown},
+				err: fmt.Errorf("failed to resolve: %s", x.domainName),
+			}
+			break
 		}
-	} else {
-		recordSet, err := createDNSRecordSetFromAnswer(r.Answer)
 
-		if err == nil {
+		if isAnswerSuspicious(msg.Question[0].Name, r.Answer) {
+			x.pool.record(resolver, outcomeSuspicious, rtt)
+
 			result = resultPair{
-				res: recordSet,
-				err: nil,
+				res: Result{Status: StatusUnknown},
+				err: fmt.Errorf("failed to resolve: %s, resolver %s: suspicious answer", x.domainName,
+					resolver.resolver),
 			}
-		} else {
+			break
+		}
+
+		res, err := createResultFromReply(r)
+
+		if err != nil {
+			x.pool.record(resolver, outcomeFailure, rtt)
+
 			result = resultPair{
-				res: nil,
-				err: err,
+				res: res,
+				err: fmt.Errorf("failed to resolve: %s, resolver %s: %v", x.domainName, resolver.resolver, err),
 			}
+			break
+		}
+
+		x.pool.record(resolver, outcomeSuccess, rtt)
+
+		// Another resolver replied. No need to query other types
+		if ctx.Err() != nil {
+			return
+		}
+
+		if i == 0 {
+			result.res = res
+		} else {
+			result.res = mergeResults(result.res, res)
+		}
+
+		// Name doesn't exist. No need to query other types
+		if res.Status == StatusNXDomain {
+			break
 		}
 	}
 
@@ -101,21 +256,48 @@ func (x *dnsClientWithQueryMessage) resolveWithSingleResolver(resolver common.IP
 }
 
 /*
-GetDNSRecords returns CNAME or A records for given domain name
+Client resolves domains using a pool of resolvers as per the provided Config. It's safe for
+concurrent use.
 */
-func GetDNSRecords(resolvers common.DNSServers, domain common.DomainType) (common.DNSRecordSet, error) {
-	x := new(dnsClientWithQueryMessage)
-	x.domainName = common.SanitizeDomainName(domain)
-	x.client = new(dns.Client)
+type Client struct {
+	pool       *ResolverPool
+	config     Config
+	httpClient *http.Client
+	// offset is used to rotate the resolvers used for each query
+	offset uint32
+}
+
+/*
+getResolversForAttempt returns the resolvers to be used for given attempt of a query. Consecutive
+attempts use next set of resolvers, wrapping around at the end of the list.
+*/
+func (c *Client) getResolversForAttempt(offset int, attempt int) []*resolverHealth {
+	active := c.pool.getActiveResolvers()
+	count := len(active)
+
+	if c.config.MaxParallel > 0 && c.config.MaxParallel < count {
+		count = c.config.MaxParallel
+	}
+
+	resolvers := make([]*resolverHealth, 0, count)
+
+	for i := 0; i < count; i++ {
+		index := (offset + attempt*count + i) % len(active)
+		resolvers = append(resolvers, active[index])
+	}
 
-	tmpMsg := new(dns.Msg)
-	tmpMsg.SetQuestion(dns.Fqdn(domain), dns.TypeA)
-	tmpMsg.RecursionDesired = true
-	x.msg = tmpMsg
+	return resolvers
+}
 
+/*
+resolveInParallel queries all the provided resolvers in parallel and returns the first
+satisfactory reply. In case all the resolvers fail, the last failure is returned.
+*/
+func (x *dnsClientWithQueryMessage) resolveInParallel(parentCtx context.Context,
+	resolvers []*resolverHealth) (Result, error) {
 	// Can't use a channel because that will only provide value to one goroutine
 	// and leave other hanging causing leak
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(parentCtx)
 	valueChan := make(chan resultPair)
 
 	defer func() {
@@ -131,19 +313,192 @@ func GetDNSRecords(resolvers common.DNSServers, domain common.DomainType) (commo
 		waitCount++
 	}
 
+	lastFailure := resultPair{
+		res: Result{Status: StatusUnknown},
+		err: fmt.Errorf("failed to resolve: %s", x.domainName),
+	}
+
 	// Wait until one resolver gives satisfactory reply
 	// In case no one provides satisfactory reply exit the loop
 	for waitCount > 0 {
-		result := <-valueChan
+		var result resultPair
+
+		select {
+		case <-ctx.Done():
+			return Result{Status: StatusUnknown}, ctx.Err()
+		case result = <-valueChan:
+		}
 
 		if result.err == nil {
 			return result.res, result.err
 		}
 
+		lastFailure = result
 		waitCount--
 	}
 
-	return nil, fmt.Errorf("failed to resolve: %s", domain)
+	return lastFailure.res, lastFailure.err
+}
+
+/*
+ResolveDomain returns CNAME, A and AAAA records for given domain name along with the status of
+query. Replies with failure status(SERVFAIL, REFUSED etc.) are ignored in favour of other resolvers.
+Failed queries are retried with next set of resolvers after backoff. In case all the attempts fail,
+the status of last failure is returned along with error. ctx.Err() is returned if ctx is done before
+a satisfactory reply.
+*/
+func (c *Client) ResolveDomain(ctx context.Context, domain common.DomainType) (Result, error) {
+	if len(c.pool.all) == 0 {
+		return Result{Status: StatusUnknown}, fmt.Errorf("no resolver to resolve: %s", domain)
+	}
+
+	x := new(dnsClientWithQueryMessage)
+	x.domainName = common.SanitizeDomainName(domain)
+	x.timeout = c.config.Timeout
+	x.udpSize = c.config.UDPSize
+	x.httpClient = c.httpClient
+	x.limiter = c.config.Limiter
+	x.pool = c.pool
+
+	for _, queryType := range queryTypes {
+		tmpMsg := new(dns.Msg)
+		tmpMsg.SetQuestion(dns.Fqdn(domain), queryType)
+		tmpMsg.RecursionDesired = true
+
+		if c.config.UDPSize > 0 {
+			tmpMsg.SetEdns0(c.config.UDPSize, false)
+		}
+
+		x.msgs = append(x.msgs, tmpMsg)
+	}
+
+	offset := int(atomic.AddUint32(&c.offset, 1) % uint32(len(c.pool.all)))
+
+	var result Result
+	var err error
+
+	for attempt := 0; attempt <= c.config.Retries; attempt++ {
+		select {
+		case <-ctx.Done():
+			return Result{Status: StatusUnknown}, ctx.Err()
+		case <-time.After(c.config.getBackoffForAttempt(attempt)):
+		}
+
+		result, err = x.resolveInParallel(ctx, c.getResolversForAttempt(offset, attempt))
+
+		if err == nil {
+			return result, nil
+		}
+	}
+
+	return result, err
+}
+
+/*
+GetDNSRecords returns CNAME, A and AAAA records for given domain name. Records are empty for NODATA
+replies. NXDOMAIN replies keep the CNAME chain ending at the non-existent name(dangling CNAME), if any,
+so records without any A/AAAA record don't imply NOERROR. Use ResolveDomain for the status.
+*/
+func (c *Client) GetDNSRecords(ctx context.Context, domain common.DomainType) (common.DNSRecordSet, error) {
+	result, err := c.ResolveDomain(ctx, domain)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Records, nil
+}
+
+/*
+ResolveDomain is same as Client.ResolveDomain using DefaultConfig
+*/
+func ResolveDomain(resolvers common.DNSServers, domain common.DomainType) (Result, error) {
+	return CreateClientInstance(resolvers, DefaultConfig()).ResolveDomain(context.Background(), domain)
+}
+
+/*
+GetDNSRecords is same as Client.GetDNSRecords using DefaultConfig
+*/
+func GetDNSRecords(resolvers common.DNSServers, domain common.DomainType) (common.DNSRecordSet, error) {
+	return CreateClientInstance(resolvers, DefaultConfig()).GetDNSRecords(context.Background(), domain)
+}
+
+/*
+Pool returns the ResolverPool used by client
+*/
+func (c *Client) Pool() *ResolverPool {
+	return c.pool
+}
+
+/*
+CreateClientInstance returns a newly initialized Client instance
+*/
+func CreateClientInstance(resolvers common.DNSServers, config Config) *Client {
+	x := new(Client)
+	x.pool = CreateResolverPoolInstance(resolvers)
+	x.config = config
+
+	for _, r := range x.pool.all {
+		r.limiter = config.ResolverLimiters.Get(r.address)
+	}
+
+	x.httpClient = &http.Client{Timeout: config.Timeout}
+	return x
+}
+
+/*
+GetRegistrableDomain returns the registrable domain(eTLD+1) for domain as per the Public Suffix List.
+Private suffixes e.g. s3.amazonaws.com aren't considered as suffix, as there can be wildcard under
+them. So amazonaws.com is returned for abc.s3.amazonaws.com. Error is returned if domain itself is
+a public suffix.
+*/
+func GetRegistrableDomain(domain string) (string, error) {
+	name := strings.Trim(common.SanitizeDomainName(domain), ".")
+
+	suffix, icann := publicsuffix.PublicSuffix(name)
+
+	// Look up the ICANN suffix the private suffix is under. Suffix without '.' is the last label
+	for !icann && strings.Contains(suffix, ".") {
+		suffix, icann = publicsuffix.PublicSuffix(suffix[strings.Index(suffix, ".")+1:])
+	}
+
+	if len(name) <= len(suffix) {
+		return "", fmt.Errorf("domain '%s' is a public suffix", domain)
+	}
+
+	// Add the label before suffix
+	prefix := name[:len(name)-len(suffix)-1]
+
+	return common.SanitizeDomainName(prefix[strings.LastIndex(prefix, ".")+1:] + "." + suffix), nil
+}
+
+/*
+GetRootDomain returns the longest of rootDomains which domain is same as or a subdomain of. Error is
+returned if domain is out-of-scope for all of rootDomains.
+*/
+func GetRootDomain(domain string, rootDomains []string) (string, error) {
+	domain = common.SanitizeDomainName(domain)
+	matchedRoot := ""
+
+	for _, rootDomain := range rootDomains {
+		rootDomain = common.SanitizeDomainName(rootDomain)
+
+		// Extra '.' to avoid matching in cases like 'abc.not-example.com' & 'example.com'
+		if domain != rootDomain && !strings.HasSuffix(domain, "."+rootDomain) {
+			continue
+		}
+
+		if len(rootDomain) > len(matchedRoot) {
+			matchedRoot = rootDomain
+		}
+	}
+
+	if matchedRoot == "" {
+		return "", fmt.Errorf("domain out-of-scope for '%s', in context of '%s'", domain,
+			strings.Join(rootDomains, "', '"))
+	}
+
+	return matchedRoot, nil
 }
 
 /*
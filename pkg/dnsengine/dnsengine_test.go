@@ -1,11 +1,17 @@
 package dnsengine_test
 
 import (
+	"context"
+	"net"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
 
 	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
 	"github.com/faizal3199/dns-wildcard-removal/pkg/dnsengine"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/ratelimit"
 )
 
 func TestGetDNSRecords(t *testing.T) {
@@ -20,7 +26,7 @@ func TestGetDNSRecords(t *testing.T) {
 		wantErr bool
 	}{
 		{
-			name: "Test for A record",
+			name: "Test for A and AAAA record",
 			args: args{
 				resolvers: common.DNSServers{"1.1.1.1", "8.8.8.8"},
 				domain:    "a.root-servers.net.",
@@ -31,6 +37,11 @@ func TestGetDNSRecords(t *testing.T) {
 					Type:  "A",
 					Value: "198.41.0.4",
 				},
+				{
+					Name:  "a.root-servers.net.",
+					Type:  "AAAA",
+					Value: "2001:503:ba3e::2:30",
+				},
 			},
 			wantErr: false,
 		},
@@ -51,6 +62,11 @@ func TestGetDNSRecords(t *testing.T) {
 					Type:  "A",
 					Value: "198.41.0.4",
 				},
+				{
+					Name:  "a.root-servers.net.",
+					Type:  "AAAA",
+					Value: "2001:503:ba3e::2:30",
+				},
 			},
 			wantErr: false,
 		},
@@ -99,6 +115,11 @@ func TestGetDNSRecords(t *testing.T) {
 					Type:  "A",
 					Value: "198.41.0.4",
 				},
+				{
+					Name:  "a.root-servers.net.",
+					Type:  "AAAA",
+					Value: "2001:503:ba3e::2:30",
+				},
 			},
 			wantErr: false,
 		},
@@ -112,6 +133,12 @@ func TestGetDNSRecords(t *testing.T) {
 				t.Errorf("GetDNSRecords() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+
+			// TTL depends on the resolver's cache
+			for i := range got {
+				got[i].TTL = 0
+			}
+
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("GetDNSRecords() = %v, want %v", got, tt.want)
 			}
@@ -119,6 +146,184 @@ func TestGetDNSRecords(t *testing.T) {
 	}
 }
 
+func TestResolveDomain(t *testing.T) {
+	type args struct {
+		resolvers common.DNSServers
+		domain    common.DomainType
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantStatus dnsengine.ResultStatus
+		wantErr    bool
+	}{
+		{
+			name: "Test for existing domain",
+			args: args{
+				resolvers: common.DNSServers{"1.1.1.1", "8.8.8.8"},
+				domain:    "a.root-servers.net.",
+			},
+			wantStatus: dnsengine.StatusNoError,
+			wantErr:    false,
+		},
+		{
+			name: "Test for NX domain",
+			args: args{
+				resolvers: common.DNSServers{"1.1.1.1", "8.8.8.8"},
+				domain:    "nx.root-servers.net.",
+			},
+			wantStatus: dnsengine.StatusNXDomain,
+			wantErr:    false,
+		},
+		{
+			name: "Test for Invalid DNS resolver",
+			args: args{
+				resolvers: common.DNSServers{"1.2.3.4"},
+				domain:    "nx.root-servers.net.",
+			},
+			wantStatus: dnsengine.StatusUnknown,
+			wantErr:    true,
+		},
+	}
+
+	t.Parallel()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dnsengine.ResolveDomain(tt.args.resolvers, tt.args.domain)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ResolveDomain() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got.Status != tt.wantStatus {
+				t.Errorf("ResolveDomain() status = %v, want %v", got.Status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestClient_ResolveDomain(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Retries with backoff", func(t *testing.T) {
+		// Nothing listens on local port 53, so every attempt fails
+		config := dnsengine.Config{
+			Timeout:     time.Second,
+			Retries:     2,
+			Backoff:     50 * time.Millisecond,
+			MaxParallel: 1,
+		}
+		client := dnsengine.CreateClientInstance(common.DNSServers{"127.0.0.1", "127.0.0.2"}, config)
+
+		start := time.Now()
+		_, err := client.ResolveDomain(context.Background(), "a.root-servers.net.")
+		elapsed := time.Since(start)
+
+		if err == nil {
+			t.Errorf("ResolveDomain() error = %v, wantErr %v", err, true)
+		}
+
+		// 50ms before first retry and 100ms before second one
+		if elapsed < 150*time.Millisecond {
+			t.Errorf("ResolveDomain() took %v, want at least %v", elapsed, 150*time.Millisecond)
+		}
+	})
+
+	t.Run("Rate limit", func(t *testing.T) {
+		config := dnsengine.DefaultConfig()
+		config.Retries = 0
+		config.Limiter = ratelimit.CreateLimiterInstance(20)
+
+		// Each attempt fails at the first query
+		client := dnsengine.CreateClientInstance(common.DNSServers{"127.0.0.1"}, config)
+
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			_, _ = client.ResolveDomain(context.Background(), "a.root-servers.net.")
+		}
+		elapsed := time.Since(start)
+
+		if elapsed < 100*time.Millisecond {
+			t.Errorf("ResolveDomain() took %v, want at least %v", elapsed, 100*time.Millisecond)
+		}
+	})
+
+	t.Run("Cancelled during backoff", func(t *testing.T) {
+		config := dnsengine.Config{
+			Timeout:     time.Second,
+			Retries:     2,
+			Backoff:     time.Minute,
+			MaxParallel: 1,
+		}
+		client := dnsengine.CreateClientInstance(common.DNSServers{"127.0.0.1"}, config)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := client.ResolveDomain(ctx, "a.root-servers.net.")
+		elapsed := time.Since(start)
+
+		if err != context.DeadlineExceeded {
+			t.Errorf("ResolveDomain() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+
+		if elapsed >= time.Minute {
+			t.Errorf("ResolveDomain() took %v, want less than %v", elapsed, time.Minute)
+		}
+	})
+
+	t.Run("No resolvers", func(t *testing.T) {
+		client := dnsengine.CreateClientInstance(common.DNSServers{}, dnsengine.DefaultConfig())
+
+		_, err := client.ResolveDomain(context.Background(), "a.root-servers.net.")
+		if err == nil {
+			t.Errorf("ResolveDomain() error = %v, wantErr %v", err, true)
+		}
+	})
+}
+
+func TestFindHijackingResolvers(t *testing.T) {
+	t.Parallel()
+
+	config := dnsengine.DefaultConfig()
+	config.Retries = 0
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("FindHijackingResolvers(): Encountered error: %v", err)
+		return
+	}
+
+	// Answers every name with an A record
+	server := &dns.Server{
+		Listener: listener,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			reply := new(dns.Msg)
+			reply.SetReply(req)
+
+			if req.Question[0].Qtype == dns.TypeA {
+				rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+				reply.Answer = append(reply.Answer, rr)
+			}
+
+			_ = w.WriteMsg(reply)
+		}),
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	defer server.Shutdown()
+
+	hijackingResolver := "tcp://" + listener.Addr().String()
+
+	// Unreachable resolvers aren't considered as hijacking
+	got := dnsengine.FindHijackingResolvers(common.DNSServers{"127.0.0.1", hijackingResolver},
+		[]string{"xyz.invalid."}, config)
+	want := common.DNSServers{hijackingResolver}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FindHijackingResolvers() = %v, want %v", got, want)
+	}
+}
+
 func TestGetParentDomain(t *testing.T) {
 	t.Parallel()
 
@@ -228,3 +433,125 @@ func TestGetParentDomain(t *testing.T) {
 		})
 	}
 }
+
+func TestGetRootDomain(t *testing.T) {
+	type args struct {
+		domain      string
+		rootDomains []string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Single root",
+			args: args{
+				domain:      "a.example.com",
+				rootDomains: []string{"example.com."},
+			},
+			want:    "example.com.",
+			wantErr: false,
+		},
+		{
+			name: "Longest root is used",
+			args: args{
+				domain:      "a.dev.example.com",
+				rootDomains: []string{"example.com.", "dev.example.com.", "example.net."},
+			},
+			want:    "dev.example.com.",
+			wantErr: false,
+		},
+		{
+			name: "Root itself",
+			args: args{
+				domain:      "Example.NET",
+				rootDomains: []string{"example.com.", "example.net."},
+			},
+			want:    "example.net.",
+			wantErr: false,
+		},
+		{
+			name: "Out-of-scope",
+			args: args{
+				domain:      "a.not-example.com",
+				rootDomains: []string{"example.com.", "example.net."},
+			},
+			want:    "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dnsengine.GetRootDomain(tt.args.domain, tt.args.rootDomains)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetRootDomain() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("GetRootDomain() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetRegistrableDomain(t *testing.T) {
+	tests := []struct {
+		name    string
+		domain  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "ICANN suffix",
+			domain:  "a.b.example.com.",
+			want:    "example.com.",
+			wantErr: false,
+		},
+		{
+			name:    "Multi label ICANN suffix",
+			domain:  "www.example.co.uk",
+			want:    "example.co.uk.",
+			wantErr: false,
+		},
+		{
+			name:    "Private suffix",
+			domain:  "bucket.s3.amazonaws.com.",
+			want:    "amazonaws.com.",
+			wantErr: false,
+		},
+		{
+			name:    "Unlisted suffix",
+			domain:  "a.b.example.internal",
+			want:    "example.internal.",
+			wantErr: false,
+		},
+		{
+			name:    "Registrable domain itself",
+			domain:  "Example.COM",
+			want:    "example.com.",
+			wantErr: false,
+		},
+		{
+			name:    "Public suffix",
+			domain:  "co.uk.",
+			want:    "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dnsengine.GetRegistrableDomain(tt.domain)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetRegistrableDomain() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("GetRegistrableDomain() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package dnsengine
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+)
+
+// Number of resolvers checked in parallel for hijacking
+const hijackCheckParallelism = 100
+
+/*
+isResolverHijackingNXDomain returns true if resolver answers any of the probe names with address
+records. Resolvers which can't be reached aren't considered as hijacking.
+*/
+func isResolverHijackingNXDomain(resolver common.IPAddressType, probeNames []string, config Config) bool {
+	client := CreateClientInstance(common.DNSServers{resolver}, config)
+
+	for _, name := range probeNames {
+		result, err := client.ResolveDomain(context.Background(), name)
+
+		if err != nil {
+			log.Debugf("Failed to check resolver %s for hijacking: %v", resolver, err)
+			continue
+		}
+
+		for _, record := range result.Records {
+			if record.Type == common.TypeA || record.Type == common.TypeAAAA {
+				log.Debugf("Resolver %s hijacked NXDOMAIN for %s: %v", resolver, name, result.Records)
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+/*
+FindHijackingResolvers queries the probe names against each resolver individually and returns the
+resolvers which answer with address records. Probe names must be known to be non-existent(e.g. random
+names under .invalid TLD), so any address returned for them is an ad or landing-page IP.
+*/
+func FindHijackingResolvers(resolvers common.DNSServers, probeNames []string, config Config) common.DNSServers {
+	isHijacking := make([]bool, len(resolvers))
+	semaphore := make(chan struct{}, hijackCheckParallelism)
+
+	var wg sync.WaitGroup
+
+	for i, resolver := range resolvers {
+		wg.Add(1)
+		semaphore <- struct{}{}
+
+		go func(i int, resolver common.IPAddressType) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			isHijacking[i] = isResolverHijackingNXDomain(resolver, probeNames, config)
+		}(i, resolver)
+	}
+
+	wg.Wait()
+
+	hijackingResolvers := make(common.DNSServers, 0)
+
+	for i, resolver := range resolvers {
+		if isHijacking[i] {
+			hijackingResolvers = append(hijackingResolvers, resolver)
+		}
+	}
+
+	return hijackingResolvers
+}
@@ -0,0 +1,318 @@
+package dnsengine
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/ratelimit"
+)
+
+const (
+	// Minimum number of queries before a resolver is judged for quarantine
+	minQueriesBeforeQuarantine = 20
+
+	// Resolvers failing more than this fraction of queries are quarantined
+	maxFailureRate = 0.5
+
+	// Resolvers giving these many suspicious answers are quarantined
+	maxSuspiciousAnswers = 3
+)
+
+/*
+queryOutcome represents the outcome of a single query to a single resolver
+*/
+type queryOutcome int
+
+const (
+	outcomeSuccess queryOutcome = iota
+	outcomeFailure
+	outcomeTimeout
+	outcomeSuspicious
+)
+
+/*
+resolverHealth tracks the health of a single resolver
+*/
+type resolverHealth struct {
+	resolver common.IPAddressType
+	network  string
+	address  string
+	limiter  *ratelimit.Limiter
+
+	mutex        sync.Mutex
+	queries      int
+	successes    int
+	failures     int
+	timeouts     int
+	suspicious   int
+	totalLatency time.Duration
+	benched      bool
+}
+
+/*
+shouldBeBenched returns true if resolver keeps failing or lying. Caller must hold the lock
+*/
+func (r *resolverHealth) shouldBeBenched() bool {
+	if r.suspicious >= maxSuspiciousAnswers {
+		return true
+	}
+
+	if r.queries < minQueriesBeforeQuarantine {
+		return false
+	}
+
+	return float64(r.failures+r.timeouts) > maxFailureRate*float64(r.queries)
+}
+
+/*
+String returns the health summary of the resolver
+*/
+func (r *resolverHealth) String() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	avgLatency := time.Duration(0)
+	if r.successes != 0 {
+		avgLatency = r.totalLatency / time.Duration(r.successes)
+	}
+
+	return fmt.Sprintf("%s queries=%d success=%d failures=%d timeouts=%d suspicious=%d avg_latency=%v benched=%v",
+		r.resolver, r.queries, r.successes, r.failures, r.timeouts, r.suspicious,
+		avgLatency.Round(time.Millisecond), r.benched)
+}
+
+/*
+ResolverPool keeps track of health of the resolvers. Resolvers that keep failing or
+giving suspicious answers are benched for rest of the run. Last active resolver is never benched.
+*/
+type ResolverPool struct {
+	all    []*resolverHealth
+	active []*resolverHealth
+	mutex  sync.RWMutex
+}
+
+/*
+getActiveResolvers returns the resolvers which are not benched. Returned slice must not be modified
+*/
+func (p *ResolverPool) getActiveResolvers() []*resolverHealth {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.active
+}
+
+/*
+bench removes the resolver from active resolvers unless it's the last one
+*/
+func (p *ResolverPool) bench(r *resolverHealth) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.active) <= 1 {
+		return false
+	}
+
+	// Create a new slice as the old one might be in use
+	active := make([]*resolverHealth, 0, len(p.active)-1)
+	for _, x := range p.active {
+		if x != r {
+			active = append(active, x)
+		}
+	}
+
+	p.active = active
+	return true
+}
+
+/*
+record updates the health of resolver with the outcome of a query and benches it if required
+*/
+func (p *ResolverPool) record(r *resolverHealth, outcome queryOutcome, latency time.Duration) {
+	r.mutex.Lock()
+
+	r.queries++
+
+	switch outcome {
+	case outcomeSuccess:
+		r.successes++
+		r.totalLatency += latency
+	case outcomeFailure:
+		r.failures++
+	case outcomeTimeout:
+		r.timeouts++
+	case outcomeSuspicious:
+		r.suspicious++
+	}
+
+	shouldBench := !r.benched && r.shouldBeBenched()
+	r.mutex.Unlock()
+
+	if shouldBench && p.bench(r) {
+		r.mutex.Lock()
+		r.benched = true
+		r.mutex.Unlock()
+
+		log.Warningf("Quarantined resolver %s for rest of the run", r)
+	}
+}
+
+/*
+ActiveResolvers returns the list of resolvers which are not benched
+*/
+func (p *ResolverPool) ActiveResolvers() common.DNSServers {
+	active := p.getActiveResolvers()
+
+	resolvers := make(common.DNSServers, 0, len(active))
+	for _, r := range active {
+		resolvers = append(resolvers, r.resolver)
+	}
+
+	return resolvers
+}
+
+/*
+HealthSummary returns the health summary of all the resolvers, one resolver per line. Benched
+resolvers are listed first.
+*/
+func (p *ResolverPool) HealthSummary() string {
+	benchedLines := make([]string, 0)
+	activeLines := make([]string, 0, len(p.all))
+
+	for _, r := range p.all {
+		r.mutex.Lock()
+		benched := r.benched
+		r.mutex.Unlock()
+
+		if benched {
+			benchedLines = append(benchedLines, r.String())
+		} else {
+			activeLines = append(activeLines, r.String())
+		}
+	}
+
+	return fmt.Sprintf("Resolvers: %d, benched: %d\n%s", len(p.all), len(benchedLines),
+		strings.Join(append(benchedLines, activeLines...), "\n"))
+}
+
+/*
+isUnderDNAME returns true if name is a subdomain of the DNAME's owner i.e. it's redirected by the DNAME
+*/
+func isUnderDNAME(name string, dname *dns.DNAME) bool {
+	owner := common.SanitizeDomainName(dname.Header().Name)
+
+	return name != owner && dns.IsSubDomain(owner, name)
+}
+
+/*
+getAnswerChain returns the names in the CNAME/DNAME chain of the queried name. The records can be in
+any order in the answer.
+*/
+func getAnswerChain(queryName string, answer []dns.RR) map[string]bool {
+	chain := map[string]bool{common.SanitizeDomainName(queryName): true}
+
+	for changed := true; changed; {
+		changed = false
+
+		for _, record := range answer {
+			switch v := record.(type) {
+			case *dns.CNAME:
+				name := common.SanitizeDomainName(v.Header().Name)
+				target := common.SanitizeDomainName(v.Target)
+
+				if chain[name] && !chain[target] {
+					chain[target] = true
+					changed = true
+				}
+			case *dns.DNAME:
+				owner := common.SanitizeDomainName(v.Header().Name)
+				target := common.SanitizeDomainName(v.Target)
+
+				for name := range chain {
+					if !isUnderDNAME(name, v) {
+						continue
+					}
+
+					// Replace the owner suffix by the target
+					if synthesized := strings.TrimSuffix(name, owner) + target; !chain[synthesized] {
+						chain[synthesized] = true
+						changed = true
+					}
+				}
+			}
+		}
+	}
+
+	return chain
+}
+
+/*
+isAnswerSuspicious returns true if the answer contains records not belonging to the CNAME/DNAME chain
+of the queried name. DNAME records are expected to be owned by a parent of a name in the chain.
+*/
+func isAnswerSuspicious(queryName string, answer []dns.RR) bool {
+	chain := getAnswerChain(queryName, answer)
+
+	for _, record := range answer {
+		if v, ok := record.(*dns.DNAME); ok {
+			redirectsChain := false
+
+			for name := range chain {
+				if isUnderDNAME(name, v) {
+					redirectsChain = true
+					break
+				}
+			}
+
+			if !redirectsChain {
+				return true
+			}
+
+			continue
+		}
+
+		if !chain[common.SanitizeDomainName(record.Header().Name)] {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+isTimeoutError returns true if err is caused due to timeout
+*/
+func isTimeoutError(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+/*
+CreateResolverPoolInstance returns a newly initialized ResolverPool instance
+*/
+func CreateResolverPoolInstance(resolvers common.DNSServers) *ResolverPool {
+	x := new(ResolverPool)
+
+	for _, resolver := range resolvers {
+		network, address, err := ParseResolverAddress(resolver)
+		if err != nil {
+			log.Warningf("Ignoring resolver: %v", err)
+			continue
+		}
+
+		x.all = append(x.all, &resolverHealth{
+			resolver: resolver,
+			network:  network,
+			address:  address,
+		})
+	}
+
+	x.active = x.all
+	return x
+}
@@ -0,0 +1,201 @@
+package dnsengine
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+)
+
+func TestResolverPool_record(t *testing.T) {
+	t.Run("Failing resolver is benched", func(t *testing.T) {
+		p := CreateResolverPoolInstance(common.DNSServers{"1.1.1.1", "8.8.8.8"})
+
+		for i := 0; i < minQueriesBeforeQuarantine; i++ {
+			p.record(p.all[0], outcomeTimeout, 0)
+			p.record(p.all[1], outcomeSuccess, time.Millisecond)
+		}
+
+		want := common.DNSServers{"8.8.8.8"}
+		if got := p.ActiveResolvers(); !reflect.DeepEqual(got, want) {
+			t.Errorf("ActiveResolvers() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Lying resolver is benched", func(t *testing.T) {
+		p := CreateResolverPoolInstance(common.DNSServers{"1.1.1.1", "8.8.8.8"})
+
+		for i := 0; i < maxSuspiciousAnswers; i++ {
+			p.record(p.all[1], outcomeSuspicious, 0)
+		}
+
+		want := common.DNSServers{"1.1.1.1"}
+		if got := p.ActiveResolvers(); !reflect.DeepEqual(got, want) {
+			t.Errorf("ActiveResolvers() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Last resolver is never benched", func(t *testing.T) {
+		p := CreateResolverPoolInstance(common.DNSServers{"1.1.1.1"})
+
+		for i := 0; i < minQueriesBeforeQuarantine; i++ {
+			p.record(p.all[0], outcomeFailure, 0)
+		}
+
+		want := common.DNSServers{"1.1.1.1"}
+		if got := p.ActiveResolvers(); !reflect.DeepEqual(got, want) {
+			t.Errorf("ActiveResolvers() = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestClient_ResolveDomain_deadResolverBenched(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("ResolveDomain(): Encountered error: %v", err)
+		return
+	}
+
+	server := &dns.Server{
+		Listener: listener,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			_ = w.WriteMsg(answerWithA(req))
+		}),
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	defer server.Shutdown()
+
+	// Never replies
+	deadConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("ResolveDomain(): Encountered error: %v", err)
+		return
+	}
+	defer deadConn.Close()
+
+	live := "tcp://" + listener.Addr().String()
+
+	config := DefaultConfig()
+	config.Timeout = 100 * time.Millisecond
+	config.Retries = 0
+	config.MaxParallel = 2
+
+	client := CreateClientInstance(common.DNSServers{live, deadConn.LocalAddr().String()}, config)
+
+	for i := 0; i < minQueriesBeforeQuarantine; i++ {
+		if _, err := client.ResolveDomain(context.Background(), "a.example.com."); err != nil {
+			t.Errorf("ResolveDomain() error = %v, wantErr %v", err, false)
+			return
+		}
+	}
+
+	// Query to the dead resolver runs until timeout after the live one replies
+	time.Sleep(3 * config.Timeout)
+
+	want := common.DNSServers{live}
+	if got := client.Pool().ActiveResolvers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ActiveResolvers() = %v, want %v", got, want)
+	}
+}
+
+func Test_isAnswerSuspicious(t *testing.T) {
+	tests := []struct {
+		name      string
+		queryName string
+		answer    []string
+		want      bool
+	}{
+		{
+			name:      "A record",
+			queryName: "a.example.com.",
+			answer:    []string{"a.example.com. 60 IN A 1.2.3.4"},
+			want:      false,
+		},
+		{
+			name:      "CNAME chain",
+			queryName: "a.example.com.",
+			answer: []string{
+				"a.example.com. 60 IN CNAME b.example.net.",
+				"b.example.net. 60 IN A 1.2.3.4",
+			},
+			want: false,
+		},
+		{
+			name:      "Out of order CNAME chain",
+			queryName: "a.example.com.",
+			answer: []string{
+				"c.example.org. 60 IN A 1.2.3.4",
+				"b.example.net. 60 IN CNAME c.example.org.",
+				"a.example.com. 60 IN CNAME b.example.net.",
+			},
+			want: false,
+		},
+		{
+			name:      "DNAME",
+			queryName: "a.example.com.",
+			answer: []string{
+				"example.com. 60 IN DNAME example.net.",
+				"a.example.com. 60 IN CNAME a.example.net.",
+				"a.example.net. 60 IN A 1.2.3.4",
+			},
+			want: false,
+		},
+		{
+			name:      "DNAME without synthesized CNAME",
+			queryName: "a.b.example.com.",
+			answer: []string{
+				"a.example.net. 60 IN A 1.2.3.4",
+				"b.example.com. 60 IN DNAME example.net.",
+			},
+			want: false,
+		},
+		{
+			name:      "DNAME for other name",
+			queryName: "a.example.com.",
+			answer: []string{
+				"example.org. 60 IN DNAME example.net.",
+				"a.example.com. 60 IN A 1.2.3.4",
+			},
+			want: true,
+		},
+		{
+			name:      "CNAME of other name",
+			queryName: "a.example.com.",
+			answer: []string{
+				"a.example.com. 60 IN A 1.2.3.4",
+				"ad.example.org. 60 IN CNAME a.example.com.",
+			},
+			want: true,
+		},
+		{
+			name:      "Record for other name",
+			queryName: "a.example.com.",
+			answer:    []string{"ad.example.org. 60 IN A 1.2.3.4"},
+			want:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answer := make([]dns.RR, 0)
+
+			for _, line := range tt.answer {
+				rr, err := dns.NewRR(line)
+				if err != nil {
+					t.Errorf("isAnswerSuspicious(): Encountered error: %v", err)
+					return
+				}
+				answer = append(answer, rr)
+			}
+
+			if got := isAnswerSuspicious(tt.queryName, answer); got != tt.want {
+				t.Errorf("isAnswerSuspicious() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
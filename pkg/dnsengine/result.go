@@ -0,0 +1,116 @@
+package dnsengine
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+)
+
+/*
+ResultStatus represents the outcome of a query, derived from RCODE of the reply
+*/
+type ResultStatus int
+
+/*
+Various outcomes of a query
+*/
+const (
+	// StatusUnknown : No valid reply received
+	StatusUnknown ResultStatus = iota
+	// StatusNoError : NOERROR reply with records
+	StatusNoError
+	// StatusNoData : NOERROR reply without any record
+	StatusNoData
+	// StatusNXDomain : NXDOMAIN reply
+	StatusNXDomain
+	// StatusServFail : SERVFAIL reply
+	StatusServFail
+	// StatusRefused : REFUSED reply
+	StatusRefused
+)
+
+/*
+String returns string format of ResultStatus
+*/
+func (s ResultStatus) String() string {
+	switch s {
+	case StatusNoError:
+		return "NOERROR"
+	case StatusNoData:
+		return "NODATA"
+	case StatusNXDomain:
+		return "NXDOMAIN"
+	case StatusServFail:
+		return "SERVFAIL"
+	case StatusRefused:
+		return "REFUSED"
+	}
+
+	return "UNKNOWN"
+}
+
+/*
+IsFailure returns true if resolver failed to answer the query. Such replies should not be
+trusted and query should be retried with another resolver.
+*/
+func (s ResultStatus) IsFailure() bool {
+	return s == StatusUnknown || s == StatusServFail || s == StatusRefused
+}
+
+/*
+Result contains the records of a domain along with the status of query
+*/
+type Result struct {
+	Status  ResultStatus
+	Records common.DNSRecordSet
+}
+
+/*
+createResultFromReply creates a Result from the reply of resolver. Returns error if reply
+is a failure or can't be parsed. NXDOMAIN reply keeps the CNAME chain(dangling CNAME), if any.
+*/
+func createResultFromReply(r *dns.Msg) (Result, error) {
+	switch r.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		recordSet, err := createDNSRecordSetFromAnswer(r.Answer)
+		if err != nil {
+			return Result{Status: StatusUnknown}, err
+		}
+
+		if r.Rcode == dns.RcodeNameError {
+			return Result{Status: StatusNXDomain, Records: recordSet}, nil
+		}
+
+		if len(recordSet) == 0 {
+			return Result{Status: StatusNoData, Records: recordSet}, nil
+		}
+
+		return Result{Status: StatusNoError, Records: recordSet}, nil
+	case dns.RcodeServerFailure:
+		return Result{Status: StatusServFail}, fmt.Errorf("got SERVFAIL reply")
+	case dns.RcodeRefused:
+		return Result{Status: StatusRefused}, fmt.Errorf("got REFUSED reply")
+	}
+
+	return Result{Status: StatusUnknown}, fmt.Errorf("got unexpected reply: %s", dns.RcodeToString[r.Rcode])
+}
+
+/*
+mergeResults merges results of queries for different record types of same domain
+*/
+func mergeResults(a Result, b Result) Result {
+	records := mergeDNSRecordSets(a.Records, b.Records)
+
+	if a.Status == StatusNoError || b.Status == StatusNoError {
+		return Result{Status: StatusNoError, Records: records}
+	}
+
+	// NXDOMAIN for any type means the name doesn't exist. It may still have a dangling CNAME chain
+	if a.Status == StatusNXDomain || b.Status == StatusNXDomain {
+		return Result{Status: StatusNXDomain, Records: records}
+	}
+
+	return Result{Status: StatusNoData, Records: records}
+}
@@ -0,0 +1,165 @@
+package dnsengine
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+)
+
+/*
+createReply returns a reply for A query of a.example.com. with the provided RCODE and answer records
+*/
+func createReply(rcode int, answer ...string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+
+	reply := new(dns.Msg)
+	reply.SetRcode(req, rcode)
+
+	for _, record := range answer {
+		rr, _ := dns.NewRR(record)
+		reply.Answer = append(reply.Answer, rr)
+	}
+
+	return reply
+}
+
+func Test_createResultFromReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   *dns.Msg
+		want    Result
+		wantErr bool
+	}{
+		{
+			name:  "NOERROR",
+			reply: createReply(dns.RcodeSuccess, "a.example.com. 60 IN A 1.2.3.4"),
+			want: Result{
+				Status: StatusNoError,
+				Records: common.DNSRecordSet{
+					{Name: "a.example.com.", Type: common.TypeA, Value: "1.2.3.4", TTL: 60},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "NODATA",
+			reply:   createReply(dns.RcodeSuccess),
+			want:    Result{Status: StatusNoData, Records: common.DNSRecordSet{}},
+			wantErr: false,
+		},
+		{
+			name:    "NXDOMAIN",
+			reply:   createReply(dns.RcodeNameError),
+			want:    Result{Status: StatusNXDomain, Records: common.DNSRecordSet{}},
+			wantErr: false,
+		},
+		{
+			name: "NXDOMAIN with CNAME chain",
+			reply: createReply(dns.RcodeNameError,
+				"a.example.com. 60 IN CNAME b.example.net.",
+				"b.example.net. 60 IN CNAME nx.example.org."),
+			want: Result{
+				Status: StatusNXDomain,
+				Records: common.DNSRecordSet{
+					{Name: "a.example.com.", Type: common.TypeCNAME, Value: "b.example.net.", TTL: 60},
+					{Name: "b.example.net.", Type: common.TypeCNAME, Value: "nx.example.org.", TTL: 60},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "DNAME",
+			reply: createReply(dns.RcodeSuccess,
+				"example.com. 60 IN DNAME example.net.",
+				"a.example.com. 60 IN CNAME a.example.net.",
+				"a.example.net. 60 IN A 1.2.3.4"),
+			want: Result{
+				Status: StatusNoError,
+				Records: common.DNSRecordSet{
+					{Name: "a.example.com.", Type: common.TypeCNAME, Value: "a.example.net.", TTL: 60},
+					{Name: "a.example.net.", Type: common.TypeA, Value: "1.2.3.4", TTL: 60},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "SERVFAIL",
+			reply:   createReply(dns.RcodeServerFailure),
+			want:    Result{Status: StatusServFail},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := createResultFromReply(tt.reply)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("createResultFromReply() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("createResultFromReply() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_mergeResults(t *testing.T) {
+	cname := common.DNSRecordSet{
+		{Name: "a.example.com.", Type: common.TypeCNAME, Value: "nx.example.net."},
+	}
+
+	tests := []struct {
+		name string
+		a    Result
+		b    Result
+		want Result
+	}{
+		{
+			name: "Dangling CNAME",
+			a:    Result{Status: StatusNoData, Records: common.DNSRecordSet{}},
+			b:    Result{Status: StatusNXDomain, Records: cname},
+			want: Result{Status: StatusNXDomain, Records: cname},
+		},
+		{
+			name: "Records of any type",
+			a:    Result{Status: StatusNoError, Records: cname},
+			b:    Result{Status: StatusNoData, Records: common.DNSRecordSet{}},
+			want: Result{Status: StatusNoError, Records: cname},
+		},
+		{
+			name: "CNAME chain with TTL ticked down",
+			a: Result{Status: StatusNoError, Records: common.DNSRecordSet{
+				{Name: "a.example.com.", Type: common.TypeCNAME, Value: "b.example.net.", TTL: 60},
+				{Name: "b.example.net.", Type: common.TypeA, Value: "1.2.3.4", TTL: 60},
+			}},
+			b: Result{Status: StatusNoError, Records: common.DNSRecordSet{
+				{Name: "a.example.com.", Type: common.TypeCNAME, Value: "b.example.net.", TTL: 59},
+				{Name: "b.example.net.", Type: common.TypeAAAA, Value: "2001:db8::1", TTL: 59},
+			}},
+			want: Result{Status: StatusNoError, Records: common.DNSRecordSet{
+				{Name: "a.example.com.", Type: common.TypeCNAME, Value: "b.example.net.", TTL: 60},
+				{Name: "b.example.net.", Type: common.TypeA, Value: "1.2.3.4", TTL: 60},
+				{Name: "b.example.net.", Type: common.TypeAAAA, Value: "2001:db8::1", TTL: 59},
+			}},
+		},
+		{
+			name: "No records",
+			a:    Result{Status: StatusNoData, Records: common.DNSRecordSet{}},
+			b:    Result{Status: StatusNoData, Records: common.DNSRecordSet{}},
+			want: Result{Status: StatusNoData, Records: common.DNSRecordSet{}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeResults(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeResults() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
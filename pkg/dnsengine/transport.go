@@ -0,0 +1,190 @@
+package dnsengine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+)
+
+/*
+Networks over which a resolver can be queried
+*/
+const (
+	NetworkUDP   = "udp"
+	NetworkTCP   = "tcp"
+	NetworkTLS   = "tcp-tls"
+	NetworkHTTPS = "https"
+)
+
+// Content type of DNS wire format messages used by DNS-over-HTTPS
+const dohContentType = "application/dns-message"
+
+// hostnameRegex matches a hostname with optional trailing '.'
+var hostnameRegex = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.?$`)
+
+/*
+isValidHost returns true if host is an IP address or a hostname. Hostnames with numeric TLD
+are rejected to avoid treating malformed IP addresses as hostnames.
+*/
+func isValidHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+
+	if !hostnameRegex.MatchString(host) {
+		return false
+	}
+
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	_, err := strconv.Atoi(labels[len(labels)-1])
+
+	return err != nil
+}
+
+/*
+parseHostPort splits the host and optional port. IPv6 address with port must be enclosed in
+brackets e.g. [2001:db8::1]:53
+*/
+func parseHostPort(hostPort string, defaultPort string) (host string, port string, err error) {
+	if net.ParseIP(hostPort) != nil {
+		return hostPort, defaultPort, nil
+	}
+
+	host, port, err = net.SplitHostPort(hostPort)
+	if err != nil {
+		// No port present
+		host = strings.TrimSuffix(strings.TrimPrefix(hostPort, "["), "]")
+		port = defaultPort
+	}
+
+	if !isValidHost(host) {
+		return "", "", fmt.Errorf("invalid host: %s", host)
+	}
+
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber <= 0 || portNumber > 65535 {
+		return "", "", fmt.Errorf("invalid port: %s", port)
+	}
+
+	return host, port, nil
+}
+
+/*
+ParseResolverAddress returns the network and address to query the resolver. Resolver is either
+host[:port](plain UDP, default port 53) or one of the following
+1) udp://host[:port]  - plain UDP, default port 53
+2) tcp://host[:port]  - plain TCP, default port 53
+3) tls://host[:port]  - DNS-over-TLS, default port 853
+4) https://host/path  - DNS-over-HTTPS, address is the complete URL
+host can be an IPv4 address, an IPv6 address(enclosed in brackets if port is present) or a hostname.
+*/
+func ParseResolverAddress(resolver common.IPAddressType) (network string, address string, err error) {
+	if !strings.Contains(resolver, "://") {
+		host, port, err := parseHostPort(resolver, "53")
+		if err != nil {
+			return "", "", fmt.Errorf("invalid resolver: %s: %v", resolver, err)
+		}
+
+		return NetworkUDP, net.JoinHostPort(host, port), nil
+	}
+
+	u, err := url.Parse(resolver)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid resolver: %s: %v", resolver, err)
+	}
+
+	if u.Hostname() == "" {
+		return "", "", fmt.Errorf("invalid resolver: %s: missing host", resolver)
+	}
+
+	defaultPort := "53"
+
+	switch u.Scheme {
+	case "udp":
+		network = NetworkUDP
+	case "tcp":
+		network = NetworkTCP
+	case "tls":
+		network = NetworkTLS
+		defaultPort = "853"
+	case "https":
+		return NetworkHTTPS, u.String(), nil
+	default:
+		return "", "", fmt.Errorf("invalid resolver: %s: unsupported scheme %s", resolver, u.Scheme)
+	}
+
+	host, port, err := parseHostPort(u.Host, defaultPort)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid resolver: %s: %v", resolver, err)
+	}
+
+	return network, net.JoinHostPort(host, port), nil
+}
+
+/*
+exchangeOverHTTPS sends the message to the DNS-over-HTTPS endpoint as per RFC 8484 and returns the reply.
+ctx.Err() is returned as is if ctx is done before the reply.
+*/
+func exchangeOverHTTPS(ctx context.Context, client *http.Client, m *dns.Msg,
+	endpoint string) (*dns.Msg, time.Duration, error) {
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	start := time.Now()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+
+		return nil, 0, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	rtt := time.Since(start)
+
+	if err != nil {
+		return nil, rtt, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, rtt, fmt.Errorf("unexpected HTTP status from %s: %s", endpoint, resp.Status)
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, rtt, err
+	}
+
+	if r.Id != m.Id {
+		return nil, rtt, dns.ErrId
+	}
+
+	return r, rtt, nil
+}
@@ -0,0 +1,383 @@
+package dnsengine
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/ratelimit"
+)
+
+/*
+answerWithA replies to every query with an A record of 1.2.3.4
+*/
+func answerWithA(req *dns.Msg) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+
+	if req.Question[0].Qtype == dns.TypeA {
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+		reply.Answer = append(reply.Answer, rr)
+	}
+
+	return reply
+}
+
+func TestParseResolverAddress(t *testing.T) {
+	tests := []struct {
+		name        string
+		resolver    string
+		wantNetwork string
+		wantAddress string
+		wantErr     bool
+	}{
+		{
+			name:        "Bare IPv4",
+			resolver:    "1.1.1.1",
+			wantNetwork: NetworkUDP,
+			wantAddress: "1.1.1.1:53",
+			wantErr:     false,
+		},
+		{
+			name:        "Bare IPv6",
+			resolver:    "2001:db8::1",
+			wantNetwork: NetworkUDP,
+			wantAddress: "[2001:db8::1]:53",
+			wantErr:     false,
+		},
+		{
+			name:        "IPv4 with port",
+			resolver:    "1.2.3.4:5353",
+			wantNetwork: NetworkUDP,
+			wantAddress: "1.2.3.4:5353",
+			wantErr:     false,
+		},
+		{
+			name:        "IPv6 with port",
+			resolver:    "[2001:db8::1]:5353",
+			wantNetwork: NetworkUDP,
+			wantAddress: "[2001:db8::1]:5353",
+			wantErr:     false,
+		},
+		{
+			name:        "IPv6 in brackets",
+			resolver:    "[2001:db8::1]",
+			wantNetwork: NetworkUDP,
+			wantAddress: "[2001:db8::1]:53",
+			wantErr:     false,
+		},
+		{
+			name:        "Hostname",
+			resolver:    "resolver.example",
+			wantNetwork: NetworkUDP,
+			wantAddress: "resolver.example:53",
+			wantErr:     false,
+		},
+		{
+			name:        "Hostname with port",
+			resolver:    "resolver.example:5353",
+			wantNetwork: NetworkUDP,
+			wantAddress: "resolver.example:5353",
+			wantErr:     false,
+		},
+		{
+			name:        "Invalid port",
+			resolver:    "1.2.3.4:99999",
+			wantNetwork: "",
+			wantAddress: "",
+			wantErr:     true,
+		},
+		{
+			name:        "Malformed IP",
+			resolver:    "1.2.3.4.5",
+			wantNetwork: "",
+			wantAddress: "",
+			wantErr:     true,
+		},
+		{
+			name:        "UDP",
+			resolver:    "udp://1.1.1.1",
+			wantNetwork: NetworkUDP,
+			wantAddress: "1.1.1.1:53",
+			wantErr:     false,
+		},
+		{
+			name:        "TCP with port",
+			resolver:    "tcp://1.1.1.1:5353",
+			wantNetwork: NetworkTCP,
+			wantAddress: "1.1.1.1:5353",
+			wantErr:     false,
+		},
+		{
+			name:        "TLS",
+			resolver:    "tls://1.1.1.1",
+			wantNetwork: NetworkTLS,
+			wantAddress: "1.1.1.1:853",
+			wantErr:     false,
+		},
+		{
+			name:        "TLS IPv6",
+			resolver:    "tls://[2001:db8::1]:8853",
+			wantNetwork: NetworkTLS,
+			wantAddress: "[2001:db8::1]:8853",
+			wantErr:     false,
+		},
+		{
+			name:        "HTTPS",
+			resolver:    "https://dns.example/dns-query",
+			wantNetwork: NetworkHTTPS,
+			wantAddress: "https://dns.example/dns-query",
+			wantErr:     false,
+		},
+		{
+			name:        "Unknown scheme",
+			resolver:    "quic://1.1.1.1",
+			wantNetwork: "",
+			wantAddress: "",
+			wantErr:     true,
+		},
+		{
+			name:        "Missing host",
+			resolver:    "tls://",
+			wantNetwork: "",
+			wantAddress: "",
+			wantErr:     true,
+		},
+		{
+			name:        "Invalid",
+			resolver:    "#1.1.1.1",
+			wantNetwork: "",
+			wantAddress: "",
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network, address, err := ParseResolverAddress(tt.resolver)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseResolverAddress() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if network != tt.wantNetwork || address != tt.wantAddress {
+				t.Errorf("ParseResolverAddress() = %v %v, want %v %v", network, address, tt.wantNetwork, tt.wantAddress)
+			}
+		})
+	}
+}
+
+func TestClient_ResolveDomain_transports(t *testing.T) {
+	want := common.DNSRecordSet{
+		{
+			Name:  "a.example.com.",
+			Type:  "A",
+			Value: "1.2.3.4",
+			TTL:   60,
+		},
+	}
+
+	t.Run("TCP", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Errorf("ResolveDomain(): Encountered error: %v", err)
+			return
+		}
+
+		server := &dns.Server{
+			Listener: listener,
+			Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+				_ = w.WriteMsg(answerWithA(req))
+			}),
+		}
+		go func() { _ = server.ActivateAndServe() }()
+		defer server.Shutdown()
+
+		client := CreateClientInstance(common.DNSServers{"tcp://" + listener.Addr().String()}, DefaultConfig())
+
+		got, err := client.GetDNSRecords(context.Background(), "a.example.com.")
+		if err != nil {
+			t.Errorf("GetDNSRecords() error = %v, wantErr %v", err, false)
+			return
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("GetDNSRecords() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("HTTPS", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+
+			req := new(dns.Msg)
+			if err := req.Unpack(body); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			packed, _ := answerWithA(req).Pack()
+			w.Header().Set("Content-Type", dohContentType)
+			_, _ = w.Write(packed)
+		}))
+		defer server.Close()
+
+		client := CreateClientInstance(common.DNSServers{server.URL + "/dns-query"}, DefaultConfig())
+		// Trust the self-signed certificate of test server
+		client.httpClient = server.Client()
+
+		got, err := client.GetDNSRecords(context.Background(), "a.example.com.")
+		if err != nil {
+			t.Errorf("GetDNSRecords() error = %v, wantErr %v", err, false)
+			return
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("GetDNSRecords() = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestClient_ResolveDomain_truncated(t *testing.T) {
+	// UDP and TCP servers must share the port
+	var udpConn net.PacketConn
+	var tcpListener net.Listener
+	var err error
+
+	for i := 0; i < 10; i++ {
+		tcpListener, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			continue
+		}
+
+		udpConn, err = net.ListenPacket("udp", tcpListener.Addr().String())
+		if err == nil {
+			break
+		}
+
+		_ = tcpListener.Close()
+	}
+
+	if err != nil {
+		t.Errorf("ResolveDomain(): Encountered error: %v", err)
+		return
+	}
+
+	fullReply := func(req *dns.Msg) *dns.Msg {
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+
+		if req.Question[0].Qtype == dns.TypeA {
+			for _, ip := range []string{"1.2.3.4", "1.2.3.5"} {
+				rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A " + ip)
+				reply.Answer = append(reply.Answer, rr)
+			}
+		}
+
+		return reply
+	}
+
+	udpServer := &dns.Server{
+		PacketConn: udpConn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			// Partial answer with TC bit set
+			reply := fullReply(req)
+			if len(reply.Answer) != 0 {
+				reply.Answer = reply.Answer[:1]
+			}
+			reply.Truncated = true
+			_ = w.WriteMsg(reply)
+		}),
+	}
+	tcpServer := &dns.Server{
+		Listener: tcpListener,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			_ = w.WriteMsg(fullReply(req))
+		}),
+	}
+
+	go func() { _ = udpServer.ActivateAndServe() }()
+	go func() { _ = tcpServer.ActivateAndServe() }()
+	defer udpServer.Shutdown()
+	defer tcpServer.Shutdown()
+
+	client := CreateClientInstance(common.DNSServers{tcpListener.Addr().String()}, DefaultConfig())
+
+	got, err := client.GetDNSRecords(context.Background(), "a.example.com.")
+	if err != nil {
+		t.Errorf("GetDNSRecords() error = %v, wantErr %v", err, false)
+		return
+	}
+
+	want := common.DNSRecordSet{
+		{
+			Name:  "a.example.com.",
+			Type:  "A",
+			Value: "1.2.3.4",
+			TTL:   60,
+		},
+		{
+			Name:  "a.example.com.",
+			Type:  "A",
+			Value: "1.2.3.5",
+			TTL:   60,
+		},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetDNSRecords() = %v, want %v", got, want)
+	}
+}
+
+func TestClient_ResolveDomain_rateLimitCancelled(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("ResolveDomain(): Encountered error: %v", err)
+		return
+	}
+
+	var queryCount int32
+
+	server := &dns.Server{
+		Listener: listener,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			atomic.AddInt32(&queryCount, 1)
+			_ = w.WriteMsg(answerWithA(req))
+		}),
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	defer server.Shutdown()
+
+	config := DefaultConfig()
+	// A and AAAA queries take the slots of first second
+	config.Limiter = ratelimit.CreateLimiterInstance(2)
+
+	client := CreateClientInstance(common.DNSServers{"tcp://" + listener.Addr().String()}, config)
+
+	_, err = client.ResolveDomain(context.Background(), "a.example.com.")
+	if err != nil {
+		t.Errorf("ResolveDomain() error = %v, wantErr %v", err, false)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = client.ResolveDomain(ctx, "b.example.com.")
+	if err != context.DeadlineExceeded {
+		t.Errorf("ResolveDomain() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Query waiting for the rate limit must not be sent once cancelled
+	time.Sleep(time.Second)
+
+	if got := atomic.LoadInt32(&queryCount); got != 2 {
+		t.Errorf("ResolveDomain() sent %d queries, want %d", got, 2)
+	}
+}
@@ -0,0 +1,262 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/dnsengine"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/logicengine"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/logicengine/probecache"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/logicengine/wildcardstruct"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/native"
+)
+
+/*
+Config for a Filter. Use DefaultConfig to get sane defaults and then set the required fields i.e.
+Domains and Resolvers.
+*/
+type Config struct {
+	// Domains to filter wildcard subdomains for. Each input domain is checked in context of the
+	// longest domain it's under
+	Domains []string
+	// AutoDetectDomain checks the input domains not under any of Domains in context of their
+	// registrable domain(eTLD+1) as per the Public Suffix List. Domains isn't required if set
+	AutoDetectDomain bool
+	// Resolvers used to resolve the input domains
+	Resolvers common.DNSServers
+	// TrustedResolvers used for wildcard probing. Same as Resolvers if empty
+	TrustedResolvers common.DNSServers
+	// Threads is the number of domains checked for wildcard concurrently
+	Threads int
+	// Concurrency is the number of concurrent lookups for input domains
+	Concurrency int
+	QueryConfig dnsengine.Config
+	ProbeConfig wildcardstruct.ProbeConfig
+	// ProbeCache persists wildcard probe results across runs. Optional, nil to always probe
+	ProbeCache *probecache.ProbeCache
+	// MaxParents is the number of parent domains whose probe results are kept in memory. Least
+	// recently used are evicted beyond it. Use 0 for no limit
+	MaxParents int
+}
+
+/*
+DefaultConfig returns the Config with same defaults as the command line
+*/
+func DefaultConfig() Config {
+	return Config{
+		Threads:     6,
+		Concurrency: 100,
+		QueryConfig: dnsengine.DefaultConfig(),
+		ProbeConfig: wildcardstruct.DefaultProbeConfig(),
+		MaxParents:  100000,
+	}
+}
+
+/*
+Result is the outcome of wildcard check for a single domain. IsWildcard is true if the domain
+matched the wildcard records of any of its parents.
+*/
+type Result struct {
+	Records common.DomainRecords
+	logicengine.Verdict
+	// Err is the error encountered while checking the domain. Verdict is meaningless if set
+	Err error
+}
+
+/*
+Filter removes wildcard subdomains of a domain. It can be embedded in other programs, it never
+exits the process. It's safe for concurrent use.
+*/
+type Filter struct {
+	config      Config
+	client      *dnsengine.Client
+	probeClient *dnsengine.Client
+}
+
+/*
+worker checks the DomainRecords received on recordsChan to be wildcard using logic engine
+and then sends the result on resultsChan.
+*/
+func worker(ctx context.Context,
+	l *logicengine.LogicEngine,
+	recordsChan <-chan common.DomainRecords,
+	resultsChan chan<- Result,
+	wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+
+	for {
+		data, more := <-recordsChan
+
+		if !more {
+			return
+		}
+
+		verdict, err := l.CheckDomain(ctx, data)
+
+		// Keep draining recordsChan until the producer stops
+		if ctx.Err() != nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+		case resultsChan <- Result{Records: data, Verdict: verdict, Err: err}:
+		}
+	}
+}
+
+/*
+FilterRecords checks the already resolved domains received on recordsChan and returns a channel of
+results. Each call uses a new cache of wildcard probes. The returned channel is closed once
+recordsChan is closed and all the domains are checked. If ctx is done, probes are stopped and
+remaining domains are drained without any result.
+*/
+func (f *Filter) FilterRecords(ctx context.Context, recordsChan <-chan common.DomainRecords) <-chan Result {
+	resultsChan := make(chan Result)
+
+	l := logicengine.CreateLogicEngineInstance(ctx, f.config.Domains, f.config.AutoDetectDomain, f.probeClient,
+		f.config.ProbeConfig, f.config.ProbeCache, f.config.MaxParents)
+
+	var wg sync.WaitGroup
+
+	log.Debugf("Initializing %d workers", f.config.Threads)
+	for i := 0; i < f.config.Threads; i++ {
+		wg.Add(1)
+		go worker(ctx, l, recordsChan, resultsChan, &wg)
+	}
+
+	go func() {
+		wg.Wait()
+		close(resultsChan)
+	}()
+
+	return resultsChan
+}
+
+/*
+FilterDomains resolves the domains received on domainChan and returns a channel of results same as
+FilterRecords. Domains without any record or failed lookups are dropped.
+*/
+func (f *Filter) FilterDomains(ctx context.Context, domainChan <-chan common.DomainType) <-chan Result {
+	recordsChan := make(chan common.DomainRecords)
+
+	native.ResolveDomains(ctx, f.client, f.config.Concurrency, domainChan, recordsChan)
+
+	return f.FilterRecords(ctx, recordsChan)
+}
+
+/*
+FilterReader is same as FilterDomains reading one domain per line from reader. Error encountered while
+reading is sent as the last result.
+*/
+func (f *Filter) FilterReader(ctx context.Context, reader io.Reader) <-chan Result {
+	domainChan := make(chan common.DomainType)
+	readErrChan := make(chan error, 1)
+
+	go func() {
+		readErrChan <- native.ReadDomains(ctx, reader, domainChan)
+	}()
+
+	results := f.FilterDomains(ctx, domainChan)
+	resultsChan := make(chan Result)
+
+	go func() {
+		defer close(resultsChan)
+
+		for result := range results {
+			select {
+			case <-ctx.Done():
+			case resultsChan <- result:
+			}
+		}
+
+		if err := <-readErrChan; err != nil {
+			select {
+			case <-ctx.Done():
+			case resultsChan <- Result{Err: err}:
+			}
+		}
+	}()
+
+	return resultsChan
+}
+
+/*
+Client returns the client used to resolve the input domains
+*/
+func (f *Filter) Client() *dnsengine.Client {
+	return f.client
+}
+
+/*
+ProbeClient returns the client used for wildcard probing
+*/
+func (f *Filter) ProbeClient() *dnsengine.Client {
+	return f.probeClient
+}
+
+/*
+CreateFilterInstance returns a newly initialized Filter as per config
+*/
+func CreateFilterInstance(config Config) (*Filter, error) {
+	if len(config.Domains) == 0 && !config.AutoDetectDomain {
+		return nil, fmt.Errorf("domain is required")
+	}
+
+	if len(config.Resolvers) == 0 {
+		return nil, fmt.Errorf("non valid resolver(DNS Server) found")
+	}
+
+	if config.Threads <= 0 || config.Concurrency <= 0 {
+		return nil, fmt.Errorf("threads and concurrency must be positive")
+	}
+
+	if config.ProbeConfig.MinTTL < 0 || config.ProbeConfig.MaxTTL < 0 {
+		return nil, fmt.Errorf("TTL bounds can't be negative")
+	}
+
+	if config.MaxParents < 0 {
+		return nil, fmt.Errorf("maximum number of parents can't be negative")
+	}
+
+	if config.ProbeConfig.Count <= 0 {
+		return nil, fmt.Errorf("number of probes must be positive")
+	}
+
+	if len(config.TrustedResolvers) == 0 {
+		config.TrustedResolvers = config.Resolvers
+	}
+
+	domains := make([]string, 0, len(config.Domains))
+	seen := map[string]bool{}
+
+	for _, domain := range config.Domains {
+		if strings.Trim(domain, ". ") == "" {
+			return nil, fmt.Errorf("empty domain found")
+		}
+
+		domain = common.SanitizeDomainName(domain)
+
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+
+	config.Domains = domains
+
+	x := new(Filter)
+	x.config = config
+	// Bulk resolution and wildcard probing use separate resolvers
+	x.client = dnsengine.CreateClientInstance(config.Resolvers, config.QueryConfig)
+	x.probeClient = dnsengine.CreateClientInstance(config.TrustedResolvers, config.QueryConfig)
+
+	return x, nil
+}
@@ -0,0 +1,274 @@
+package filter
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+)
+
+/*
+startTestServer starts a local DNS server over TCP for example.com. with a wildcard under
+wild.example.com. and returns the resolver address for it.
+*/
+func startTestServer() (common.IPAddressType, func() error, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+
+	server := &dns.Server{
+		Listener: listener,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			reply := new(dns.Msg)
+			reply.SetReply(req)
+
+			name := req.Question[0].Name
+			value := ""
+
+			switch {
+			case name == "real.example.com.":
+				value = "5.6.7.8"
+			case strings.HasSuffix(name, ".wild.example.com."):
+				value = "1.2.3.4"
+			default:
+				reply.Rcode = dns.RcodeNameError
+			}
+
+			if value != "" && req.Question[0].Qtype == dns.TypeA {
+				rr, _ := dns.NewRR(name + " 60 IN A " + value)
+				reply.Answer = append(reply.Answer, rr)
+			}
+
+			_ = w.WriteMsg(reply)
+		}),
+	}
+	go func() { _ = server.ActivateAndServe() }()
+
+	return "tcp://" + listener.Addr().String(), server.Shutdown, nil
+}
+
+func TestCreateFilterInstance(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  func() Config
+		wantErr bool
+	}{
+		{
+			name: "Valid config",
+			config: func() Config {
+				config := DefaultConfig()
+				config.Domains = []string{"example.com"}
+				config.Resolvers = common.DNSServers{"1.1.1.1"}
+				return config
+			},
+			wantErr: false,
+		},
+		{
+			name: "Missing domain",
+			config: func() Config {
+				config := DefaultConfig()
+				config.Resolvers = common.DNSServers{"1.1.1.1"}
+				return config
+			},
+			wantErr: true,
+		},
+		{
+			name: "Auto detected domain",
+			config: func() Config {
+				config := DefaultConfig()
+				config.AutoDetectDomain = true
+				config.Resolvers = common.DNSServers{"1.1.1.1"}
+				return config
+			},
+			wantErr: false,
+		},
+		{
+			name: "Missing resolvers",
+			config: func() Config {
+				config := DefaultConfig()
+				config.Domains = []string{"example.com"}
+				return config
+			},
+			wantErr: true,
+		},
+		{
+			name: "Empty domain",
+			config: func() Config {
+				config := DefaultConfig()
+				config.Domains = []string{"example.com", ""}
+				config.Resolvers = common.DNSServers{"1.1.1.1"}
+				return config
+			},
+			wantErr: true,
+		},
+		{
+			name: "Zero threads",
+			config: func() Config {
+				config := DefaultConfig()
+				config.Domains = []string{"example.com"}
+				config.Resolvers = common.DNSServers{"1.1.1.1"}
+				config.Threads = 0
+				return config
+			},
+			wantErr: true,
+		},
+		{
+			name: "Negative max parents",
+			config: func() Config {
+				config := DefaultConfig()
+				config.Domains = []string{"example.com"}
+				config.Resolvers = common.DNSServers{"1.1.1.1"}
+				config.MaxParents = -1
+				return config
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CreateFilterInstance(tt.config())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CreateFilterInstance() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFilter_FilterReader(t *testing.T) {
+	resolver, shutdown, err := startTestServer()
+	if err != nil {
+		t.Errorf("FilterReader(): Encountered error: %v", err)
+		return
+	}
+	defer shutdown()
+
+	config := DefaultConfig()
+	// Domains are checked in context of the longest root
+	config.Domains = []string{"example.net", "example.com", "wild.example.com"}
+	config.Resolvers = common.DNSServers{resolver}
+
+	f, err := CreateFilterInstance(config)
+	if err != nil {
+		t.Errorf("FilterReader(): Encountered error: %v", err)
+		return
+	}
+
+	input := "abc.wild.example.com\nreal.example.com\n\nnx.example.com\n"
+
+	got := map[string]bool{}
+
+	for result := range f.FilterReader(context.Background(), strings.NewReader(input)) {
+		if result.Err != nil {
+			t.Errorf("FilterReader() error = %v, wantErr %v", result.Err, false)
+			continue
+		}
+
+		got[result.Records.DomainName] = result.IsWildcard
+
+		if result.IsWildcard && result.MatchedParent != "wild.example.com." {
+			t.Errorf("FilterReader() matched parent = %v, want %v", result.MatchedParent, "wild.example.com.")
+		}
+
+		if len(result.Trace) != len(result.CheckedParents) {
+			t.Errorf("FilterReader() trace = %v, want a step for each of %v", result.Trace, result.CheckedParents)
+		}
+	}
+
+	// Domains without records are dropped
+	want := map[string]bool{
+		"abc.wild.example.com.": true,
+		"real.example.com.":     false,
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("FilterReader() got = %v, want %v", got, want)
+	}
+
+	for domain, isWildcard := range want {
+		if gotIsWildcard, ok := got[domain]; !ok || gotIsWildcard != isWildcard {
+			t.Errorf("FilterReader() got = %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+func TestFilter_FilterReader_autoDetectDomain(t *testing.T) {
+	resolver, shutdown, err := startTestServer()
+	if err != nil {
+		t.Errorf("FilterReader(): Encountered error: %v", err)
+		return
+	}
+	defer shutdown()
+
+	config := DefaultConfig()
+	config.AutoDetectDomain = true
+	config.Resolvers = common.DNSServers{resolver}
+
+	f, err := CreateFilterInstance(config)
+	if err != nil {
+		t.Errorf("FilterReader(): Encountered error: %v", err)
+		return
+	}
+
+	input := "abc.wild.example.com\nreal.example.com\n"
+
+	for result := range f.FilterReader(context.Background(), strings.NewReader(input)) {
+		if result.Err != nil {
+			t.Errorf("FilterReader() error = %v, wantErr %v", result.Err, false)
+			continue
+		}
+
+		// Parents are checked up to the registrable domain
+		if result.CheckedParents[0] != "example.com." {
+			t.Errorf("FilterReader() checked parents = %v, want from %v", result.CheckedParents, "example.com.")
+		}
+
+		wantIsWildcard := result.Records.DomainName == "abc.wild.example.com."
+		if result.IsWildcard != wantIsWildcard {
+			t.Errorf("FilterReader() %v is wildcard = %v, want %v", result.Records.DomainName,
+				result.IsWildcard, wantIsWildcard)
+		}
+	}
+}
+
+func TestFilter_FilterRecords(t *testing.T) {
+	config := DefaultConfig()
+	config.Domains = []string{"example.com"}
+	config.Resolvers = common.DNSServers{"127.0.0.1"}
+
+	f, err := CreateFilterInstance(config)
+	if err != nil {
+		t.Errorf("FilterRecords(): Encountered error: %v", err)
+		return
+	}
+
+	recordsChan := make(chan common.DomainRecords, 1)
+	recordsChan <- common.DomainRecords{
+		DomainName: "abc.evil.com.",
+		Records: common.DNSRecordSet{
+			{Name: "abc.evil.com.", Type: common.TypeA, Value: "0.0.0.0"},
+		},
+	}
+	close(recordsChan)
+
+	count := 0
+
+	for result := range f.FilterRecords(context.Background(), recordsChan) {
+		count++
+
+		// Out-of-scope domains are reported as error
+		if result.Err == nil {
+			t.Errorf("FilterRecords() error = %v, wantErr %v", result.Err, true)
+		}
+	}
+
+	if count != 1 {
+		t.Errorf("FilterRecords() got %d results, want %d", count, 1)
+	}
+}
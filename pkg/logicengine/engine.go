@@ -1,12 +1,17 @@
 package logicengine
 
 import (
+	"context"
+	"fmt"
+	"sort"
+
 	mapset "github.com/deckarep/golang-set"
-	log "github.com/sirupsen/logrus"
 
 	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
 	"github.com/faizal3199/dns-wildcard-removal/pkg/dnsengine"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/logicengine/probecache"
 	"github.com/faizal3199/dns-wildcard-removal/pkg/logicengine/store"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/logicengine/wildcardstruct"
 )
 
 /*
@@ -14,21 +19,127 @@ LogicEngine exposes function to check if a domain is wildcard. All the complexit
 by it.
 */
 type LogicEngine struct {
-	resolvers     common.DNSServers
-	jobDomainName string
-	store         store.Store
+	// probeCtx is the lifetime of parent probes, which are shared by all the callers of CheckDomain
+	probeCtx         context.Context
+	client           *dnsengine.Client
+	jobDomainNames   []string
+	autoDetectDomain bool
+	store            store.Store
+}
+
+/*
+Verdict is the outcome of wildcard check for a domain
+*/
+type Verdict struct {
+	IsWildcard bool
+	// CheckedParents are the parent domains consulted, starting from topmost domain
+	CheckedParents []string
+	// MatchedParent is the parent domain whose wildcard records matched. Empty if not a wildcard
+	MatchedParent string
+	// MatchedRecords are the wildcard records of MatchedParent
+	MatchedRecords common.DNSRecordSet
+	// Trace has a step for each of CheckedParents explaining the decision
+	Trace []TraceStep
 }
 
 /*
-IsDomainWildCard checks if the provided domain is a wildcard. It will check all parent domains,
-which dnsengine.GetParentDomain returns, starting from smallest domain.The function returns
-the error, if any, encountered by dnsengine.GetParentDomain.
+TraceStep explains the comparison of a domain against a single parent's wildcard records. The sets
+are the values compared i.e. A/AAAA values and, for CNAME, the target.
 */
-func (l *LogicEngine) IsDomainWildCard(domainRecord common.DomainRecords) (bool, error) {
-	parentDomainList, err := dnsengine.GetParentDomain(domainRecord.DomainName, l.jobDomainName)
+type TraceStep struct {
+	Parent       string
+	ParentValues []string
+	DomainValues []string
+	// IsSubset is the result of the comparison. It's false if all the probes were NXDOMAIN
+	IsSubset bool
+	// ProbeErr is the last error encountered while probing the parent, if any
+	ProbeErr error
+}
 
+/*
+getSortedValues returns the values compared for wildcard from the record sets, sorted
+*/
+func getSortedValues(recordSets []common.DNSRecordSet) []string {
+	values := make([]string, 0)
+
+	for _, value := range getSetFromRecordsArray(recordSets, common.TypeA).
+		Union(getSetFromRecordsArray(recordSets, common.TypeAAAA)).ToSlice() {
+		values = append(values, value.(common.RecordValueType))
+	}
+
+	sort.Strings(values)
+
+	return values
+}
+
+/*
+getWildcardRecords returns the unique records from the probe results of parentDomain. The random
+probed names are replaced by *.parentDomain
+*/
+func getWildcardRecords(parentDomain string, parentDomainRecords []common.DNSRecordSet) common.DNSRecordSet {
+	records := make(common.DNSRecordSet, 0)
+	// TTL differs across probes, so it isn't a part of key
+	seen := map[common.DNSRecord]bool{}
+
+	for _, recordSet := range parentDomainRecords {
+		if len(recordSet) == 0 {
+			continue
+		}
+
+		// Records start from the probed name
+		probedName := recordSet[0].Name
+
+		for _, record := range recordSet {
+			if record.Name == probedName {
+				record.Name = "*." + parentDomain
+			}
+
+			key := record
+			key.TTL = 0
+
+			if !seen[key] {
+				seen[key] = true
+				records = append(records, record)
+			}
+		}
+	}
+
+	return records
+}
+
+/*
+getJobDomain returns the longest job domain the domain is under. If auto detection is enabled, the
+registrable domain is used for domains not under any of job domains.
+*/
+func (l *LogicEngine) getJobDomain(domainName string) (string, error) {
+	jobDomain, err := dnsengine.GetRootDomain(domainName, l.jobDomainNames)
+
+	if err != nil && l.autoDetectDomain {
+		return dnsengine.GetRegistrableDomain(domainName)
+	}
+
+	return jobDomain, err
+}
+
+/*
+CheckDomain checks if the provided domain is a wildcard. It will check all parent domains, which
+dnsengine.GetParentDomain returns for the job domain, starting from smallest domain. The check
+stops at the first parent matching the domain's records. The function returns the error, if any,
+encountered while finding the job domain or parent domains, or ctx.Err() if ctx is done before the
+check completes.
+*/
+func (l *LogicEngine) CheckDomain(ctx context.Context, domainRecord common.DomainRecords) (Verdict, error) {
+	verdict := Verdict{CheckedParents: make([]string, 0), Trace: make([]TraceStep, 0)}
+
+	jobDomain, err := l.getJobDomain(domainRecord.DomainName)
 	if err != nil {
-		return false, err
+		return verdict, err
+	}
+
+	parentDomainList, err := dnsengine.GetParentDomain(domainRecord.DomainName, jobDomain)
+
+	if err != nil {
+		return verdict, err
 	}
 
 	// Start the check from topmost domain. This will avoid any random domains in between
@@ -36,23 +147,55 @@ func (l *LogicEngine) IsDomainWildCard(domainRecord common.DomainRecords) (bool,
 		parentDomainObject, _ := l.store.GetOrCreateDomainObject(parentDomain)
 
 		// Ignore the error here. We don't want any single error from bunch of iterations to
-		// lead to domain being marked as not-a-wildcard
-		parentDomainRecords, _ := parentDomainObject.GetResults(l.resolvers)
+		// lead to domain being marked as not-a-wildcard. It's only reported in trace
+		parentDomainRecords, probeErr := parentDomainObject.GetResults(ctx, l.probeCtx, l.client)
+
+		if ctx.Err() != nil {
+			return verdict, ctx.Err()
+		}
 
-		if compareRecordsForWildCard(domainRecord.Records, parentDomainRecords) {
-			return true, nil
+		verdict.CheckedParents = append(verdict.CheckedParents, parentDomain)
+
+		isWildCard, err := compareRecordsForWildCard(domainRecord.Records, parentDomainRecords)
+
+		verdict.Trace = append(verdict.Trace, TraceStep{
+			Parent:       parentDomain,
+			ParentValues: getSortedValues(parentDomainRecords),
+			DomainValues: getSortedValues([]common.DNSRecordSet{domainRecord.Records}),
+			IsSubset:     isWildCard,
+			ProbeErr:     probeErr,
+		})
+
+		if err != nil {
+			return verdict, fmt.Errorf("%s: %v", domainRecord.DomainName, err)
+		}
+
+		if isWildCard {
+			verdict.IsWildcard = true
+			verdict.MatchedParent = parentDomain
+			verdict.MatchedRecords = getWildcardRecords(parentDomain, parentDomainRecords)
+			return verdict, nil
 		}
 	}
 
-	return false, nil
+	return verdict, nil
+}
+
+/*
+IsDomainWildCard is same as CheckDomain returning only whether the domain is a wildcard
+*/
+func (l *LogicEngine) IsDomainWildCard(ctx context.Context, domainRecord common.DomainRecords) (bool, error) {
+	verdict, err := l.CheckDomain(ctx, domainRecord)
+
+	return verdict.IsWildcard, err
 }
 
 /*
 How is mapset created?
 1) If DNSRecordSet is of CNAME type. Then only CNAME target value is used for mapset
-2) If DNSRecordSet is of A type. Then all A values are used for mapset
+2) If DNSRecordSet is of A/AAAA type. Then all values of `recordType` are used for mapset
 */
-func getSetFromRecords(x common.DNSRecordSet) mapset.Set {
+func getSetFromRecords(x common.DNSRecordSet, recordType common.RecordTypeType) mapset.Set {
 	tempSet := mapset.NewSet()
 
 	if x == nil || len(x) == 0 {
@@ -60,23 +203,25 @@ func getSetFromRecords(x common.DNSRecordSet) mapset.Set {
 	}
 
 	// If CNAME : only use target value
-	if x[0].Type == "CNAME" {
+	if x[0].Type == common.TypeCNAME {
 		tempSet.Add(x[0].Value)
 	} else {
-		// If A : use all values
+		// If A/AAAA : use all values of the type
 		for _, record := range x {
-			tempSet.Add(record.Value)
+			if record.Type == recordType {
+				tempSet.Add(record.Value)
+			}
 		}
 	}
 
 	return tempSet
 }
 
-func getSetFromRecordsArray(x []common.DNSRecordSet) mapset.Set {
+func getSetFromRecordsArray(x []common.DNSRecordSet, recordType common.RecordTypeType) mapset.Set {
 	tempSet := mapset.NewSet()
 
 	for _, recordSet := range x {
-		tempSet = tempSet.Union(getSetFromRecords(recordSet))
+		tempSet = tempSet.Union(getSetFromRecords(recordSet, recordType))
 	}
 
 	return tempSet
@@ -84,19 +229,20 @@ func getSetFromRecordsArray(x []common.DNSRecordSet) mapset.Set {
 
 /*
 compareRecordsForWildCard matched currDomain's and parentDomain's records for static wildcard detection.
-Returns true if current domain matches for wildcard else false.
-
+Returns true if current domain matches for wildcard else false. Error is returned if currDomain
+doesn't have any record.
 
 Following is the logic for wildcard match:
 
-The function creates a mapset of records for currDomain(regardless of CNAME or A type). The function then checks
-if the newly created mapset is subset of parentDomain's mapset.
+The function creates a mapset of records for currDomain(regardless of CNAME, A or AAAA type) for each
+address type. The function then checks if each of the newly created mapset is subset of parentDomain's
+mapset of same address type.
 
 How is mapset created?
 1) If DNSRecordSet is of CNAME type. Then only CNAME target value is used for mapset
-2) If DNSRecordSet is of A type. Then all A values are used for mapset
+2) If DNSRecordSet is of A/AAAA type. Then all A/AAAA values are used for respective mapset
 */
-func compareRecordsForWildCard(currDomain common.DNSRecordSet, parentDomain []common.DNSRecordSet) bool {
+func compareRecordsForWildCard(currDomain common.DNSRecordSet, parentDomain []common.DNSRecordSet) (bool, error) {
 	// NX Domain parentDomain
 	areAllRecordsNX := true
 	for _, recordSet := range parentDomain {
@@ -107,27 +253,43 @@ func compareRecordsForWildCard(currDomain common.DNSRecordSet, parentDomain []co
 	}
 
 	if areAllRecordsNX {
-		return false
+		return false, nil
 	}
 
-	// currDomain can't have zero records because massdns provides the data
+	// Backends don't provide domains without records. Still the records can come from anywhere
 	if len(currDomain) == 0 {
-		log.Fatalf("Invalid record used for comparison: %v", currDomain)
+		return false, fmt.Errorf("invalid record used for comparison: %v", currDomain)
 	}
 
-	currDomainSet := getSetFromRecords(currDomain)
-	parentDomainSet := getSetFromRecordsArray(parentDomain)
+	for _, recordType := range []common.RecordTypeType{common.TypeA, common.TypeAAAA} {
+		currDomainSet := getSetFromRecords(currDomain, recordType)
+		parentDomainSet := getSetFromRecordsArray(parentDomain, recordType)
+
+		if !currDomainSet.IsSubset(parentDomainSet) {
+			return false, nil
+		}
+	}
 
-	return currDomainSet.IsSubset(parentDomainSet)
+	return true, nil
 }
 
 /*
-CreateLogicEngineInstance returns a newly initialized object of LogicEngine.
+CreateLogicEngineInstance returns a newly initialized object of LogicEngine for domains under any of
+domainNames. Each domain is checked in context of the longest domain name it's under. client is used to probe
+the parent domains as per probeConfig. Probe results are looked up in and saved to probeCache,
+if not nil. Probe results of at most maxParents parent domains are kept in memory, use 0 for
+no limit. If autoDetectDomain is true, domains not under any of domainNames are checked in context
+of their registrable domain as per the Public Suffix List. Probes run until ctx is done, regardless
+of ctx of the CheckDomain call starting them.
 */
-func CreateLogicEngineInstance(domainName string, resolvers common.DNSServers) *LogicEngine {
+func CreateLogicEngineInstance(ctx context.Context, domainNames []string, autoDetectDomain bool,
+	client *dnsengine.Client, probeConfig wildcardstruct.ProbeConfig, probeCache *probecache.ProbeCache,
+	maxParents int) *LogicEngine {
 	x := new(LogicEngine)
-	x.resolvers = resolvers
-	x.jobDomainName = domainName
-	x.store = *store.CreateStoreInstance()
+	x.probeCtx = ctx
+	x.client = client
+	x.jobDomainNames = domainNames
+	x.autoDetectDomain = autoDetectDomain
+	x.store = *store.CreateStoreInstance(probeConfig, probeCache, maxParents)
 	return x
 }
@@ -1,9 +1,13 @@
 package logicengine
 
 import (
+	"context"
+	"reflect"
 	"testing"
 
 	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/dnsengine"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/logicengine/wildcardstruct"
 )
 
 func Test_LogicEngine_IsDomainWildCard(t *testing.T) {
@@ -97,9 +101,11 @@ func Test_LogicEngine_IsDomainWildCard(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			l := CreateLogicEngineInstance(tt.fields.jobDomainName, tt.fields.resolvers)
+			client := dnsengine.CreateClientInstance(tt.fields.resolvers, dnsengine.DefaultConfig())
+			l := CreateLogicEngineInstance(context.Background(), []string{tt.fields.jobDomainName}, false, client,
+				wildcardstruct.DefaultProbeConfig(), nil, 0)
 
-			got, err := l.IsDomainWildCard(tt.args.domainRecord)
+			got, err := l.IsDomainWildCard(context.Background(), tt.args.domainRecord)
 
 			if (err != nil) != tt.wantErr {
 				t.Errorf("IsDomainWildCard() error = %v, wantErr %v", err, tt.wantErr)
@@ -161,12 +167,25 @@ func Test_compareRecordsForWildCard(t *testing.T) {
 				Value: "2.2.3.5",
 			},
 		},
+		{
+			{
+				Name:  "dual-stack",
+				Type:  "A",
+				Value: "3.3.3.3",
+			},
+			{
+				Name:  "dual-stack",
+				Type:  "AAAA",
+				Value: "2001:db8::1",
+			},
+		},
 	}
 
 	tests := []struct {
-		name string
-		args args
-		want bool
+		name    string
+		args    args
+		want    bool
+		wantErr bool
 	}{
 		{
 			name: "CNAME with no A",
@@ -291,6 +310,58 @@ func Test_compareRecordsForWildCard(t *testing.T) {
 			},
 			want: false,
 		},
+		{
+			name: "AAAA record from same group",
+			args: args{
+				currDomain: common.DNSRecordSet{
+					{
+						Name:  "x",
+						Type:  "AAAA",
+						Value: "2001:db8::1",
+					},
+				},
+				parentDomain: commonParentRecord,
+			},
+			want: true,
+		},
+		{
+			name: "A and AAAA records from same group",
+			args: args{
+				currDomain: common.DNSRecordSet{
+					{
+						Name:  "x",
+						Type:  "A",
+						Value: "3.3.3.3",
+					},
+					{
+						Name:  "x",
+						Type:  "AAAA",
+						Value: "2001:db8::1",
+					},
+				},
+				parentDomain: commonParentRecord,
+			},
+			want: true,
+		},
+		{
+			name: "valid A with different AAAA record",
+			args: args{
+				currDomain: common.DNSRecordSet{
+					{
+						Name:  "x",
+						Type:  "A",
+						Value: "3.3.3.3",
+					},
+					{
+						Name:  "x",
+						Type:  "AAAA",
+						Value: "2001:db8::2",
+					},
+				},
+				parentDomain: commonParentRecord,
+			},
+			want: false,
+		},
 		{
 			name: "NX Parent domain",
 			args: args{
@@ -356,13 +427,59 @@ func Test_compareRecordsForWildCard(t *testing.T) {
 			},
 			want: false,
 		},
+		{
+			name: "validate erroneous behaviour: currDomain = empty",
+			args: args{
+				currDomain:   common.DNSRecordSet{},
+				parentDomain: commonParentRecord,
+			},
+			want:    false,
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := compareRecordsForWildCard(tt.args.currDomain, tt.args.parentDomain); got != tt.want {
+			got, err := compareRecordsForWildCard(tt.args.currDomain, tt.args.parentDomain)
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("compareRecordsForWildCard() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if got != tt.want {
 				t.Errorf("compareRecordsForWildCard() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func Test_getWildcardRecords(t *testing.T) {
+	parentRecords := []common.DNSRecordSet{
+		{
+			{Name: "rand0m1.example.com.", Type: "CNAME", Value: "cdn.example.net."},
+			{Name: "cdn.example.net.", Type: "A", Value: "1.2.3.4"},
+		},
+		{},
+		{
+			// TTL isn't considered for uniqueness
+			{Name: "rand0m2.example.com.", Type: "CNAME", Value: "cdn.example.net.", TTL: 30},
+			{Name: "cdn.example.net.", Type: "A", Value: "1.2.3.4", TTL: 30},
+		},
+		{
+			{Name: "rand0m3.example.com.", Type: "A", Value: "5.6.7.8"},
+		},
+	}
+
+	want := common.DNSRecordSet{
+		{Name: "*.example.com.", Type: "CNAME", Value: "cdn.example.net."},
+		{Name: "cdn.example.net.", Type: "A", Value: "1.2.3.4"},
+		{Name: "*.example.com.", Type: "A", Value: "5.6.7.8"},
+	}
+
+	got := getWildcardRecords("example.com.", parentRecords)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getWildcardRecords() = %v, want %v", got, want)
+	}
+}
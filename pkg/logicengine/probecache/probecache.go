@@ -0,0 +1,264 @@
+package probecache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/logicengine/wildcardstruct"
+)
+
+// Version of the cache file format. Files with other versions are ignored
+const cacheFileVersion = 1
+
+/*
+entry is the probe results of a single parent domain
+*/
+type entry struct {
+	Results  []common.DNSRecordSet `json:"results"`
+	ProbedAt time.Time             `json:"probed_at"`
+}
+
+/*
+cacheFile is the on-disk format. Entries are grouped by resolver set fingerprint and then
+keyed by parent domain name.
+*/
+type cacheFile struct {
+	Version int                         `json:"version"`
+	Entries map[string]map[string]entry `json:"entries"`
+}
+
+/*
+entryKey identifies an entry in the cache
+*/
+type entryKey struct {
+	fingerprint string
+	domainName  string
+}
+
+/*
+ProbeCache persists the probe results of parent domains across runs in a JSON file. Results are
+keyed by the parent domain and the fingerprint of resolvers and probe config used for probing. Oldest
+probed entries are dropped once there are more than maxEntries entries. It's safe for concurrent use.
+*/
+type ProbeCache struct {
+	path        string
+	fingerprint string
+	maxAge      time.Duration
+	maxEntries  int
+	entries     map[string]map[string]entry
+	// order has entryKey of all the entries, oldest probed first
+	order    *list.List
+	elements map[entryKey]*list.Element
+	mutex    sync.Mutex
+}
+
+/*
+Fingerprint returns an identifier for the set of resolvers and the number of probes as per probeConfig.
+It doesn't depend on the order of resolvers. TTL bounds aren't a part of it, as they don't change the
+results.
+*/
+func Fingerprint(resolvers common.DNSServers, probeConfig wildcardstruct.ProbeConfig) string {
+	sorted := make([]string, len(resolvers))
+	copy(sorted, resolvers)
+	sort.Strings(sorted)
+
+	probes := fmt.Sprintf("probes=%d", probeConfig.Count)
+	if probeConfig.Adaptive {
+		probes += fmt.Sprintf(" adaptive max=%d", probeConfig.MaxCount)
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(append(sorted, probes), "\n")))
+
+	return hex.EncodeToString(sum[:8])
+}
+
+/*
+isFresh returns true if the entry isn't older than maxAge. Entries never expire if maxAge is 0
+*/
+func (p *ProbeCache) isFresh(e entry) bool {
+	return p.maxAge == 0 || time.Since(e.ProbedAt) <= p.maxAge
+}
+
+/*
+Get returns the cached results for domainName, along with the time they were probed at, if present and
+not expired
+*/
+func (p *ProbeCache) Get(domainName string) ([]common.DNSRecordSet, time.Time, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	e, ok := p.entries[p.fingerprint][common.SanitizeDomainName(domainName)]
+	if !ok || !p.isFresh(e) {
+		return nil, time.Time{}, false
+	}
+
+	return e.Results, e.ProbedAt, true
+}
+
+/*
+add adds the entry as the latest probed one and drops the oldest probed entries beyond maxEntries
+*/
+func (p *ProbeCache) add(key entryKey, e entry) {
+	if p.entries[key.fingerprint] == nil {
+		p.entries[key.fingerprint] = map[string]entry{}
+	}
+
+	p.entries[key.fingerprint][key.domainName] = e
+
+	if element, ok := p.elements[key]; ok {
+		p.order.MoveToBack(element)
+	} else {
+		p.elements[key] = p.order.PushBack(key)
+	}
+
+	for p.maxEntries > 0 && p.order.Len() > p.maxEntries {
+		p.remove(p.order.Front().Value.(entryKey))
+	}
+}
+
+/*
+remove removes the entry identified by key
+*/
+func (p *ProbeCache) remove(key entryKey) {
+	p.order.Remove(p.elements[key])
+	delete(p.elements, key)
+
+	delete(p.entries[key.fingerprint], key.domainName)
+
+	if len(p.entries[key.fingerprint]) == 0 {
+		delete(p.entries, key.fingerprint)
+	}
+}
+
+/*
+Set caches the results for domainName. It's written to disk on Save.
+*/
+func (p *ProbeCache) Set(domainName string, results []common.DNSRecordSet) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	key := entryKey{fingerprint: p.fingerprint, domainName: common.SanitizeDomainName(domainName)}
+
+	p.add(key, entry{Results: results, ProbedAt: time.Now()})
+}
+
+/*
+Save writes the cache to disk dropping the expired entries. The file is replaced atomically so an
+interrupted save doesn't corrupt the cache.
+*/
+func (p *ProbeCache) Save() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for element := p.order.Front(); element != nil; {
+		next := element.Next()
+		key := element.Value.(entryKey)
+
+		if !p.isFresh(p.entries[key.fingerprint][key.domainName]) {
+			p.remove(key)
+		}
+
+		element = next
+	}
+
+	data, err := json.Marshal(cacheFile{Version: cacheFileVersion, Entries: p.entries})
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(p.path), filepath.Base(p.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), p.path)
+}
+
+/*
+load reads the cache file. Missing file is treated as empty cache.
+*/
+func (p *ProbeCache) load() error {
+	data, err := ioutil.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var file cacheFile
+
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return fmt.Errorf("invalid probe cache %s: %v", p.path, err)
+	}
+
+	// Start afresh if the format changed
+	if file.Version != cacheFileVersion {
+		return nil
+	}
+
+	keys := make([]entryKey, 0)
+
+	for fingerprint, domains := range file.Entries {
+		for domainName := range domains {
+			keys = append(keys, entryKey{fingerprint: fingerprint, domainName: domainName})
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return file.Entries[keys[i].fingerprint][keys[i].domainName].ProbedAt.Before(
+			file.Entries[keys[j].fingerprint][keys[j].domainName].ProbedAt)
+	})
+
+	for _, key := range keys {
+		p.add(key, file.Entries[key.fingerprint][key.domainName])
+	}
+
+	return nil
+}
+
+/*
+CreateProbeCacheInstance returns a ProbeCache loaded from path. Results are looked up and stored
+for the resolvers identified by fingerprint. Entries older than maxAge are ignored, use 0 to
+never expire the entries. At most maxEntries entries are kept in memory and on disk, use 0 for no
+limit.
+*/
+func CreateProbeCacheInstance(path string, fingerprint string, maxAge time.Duration,
+	maxEntries int) (*ProbeCache, error) {
+	x := new(ProbeCache)
+	x.path = path
+	x.fingerprint = fingerprint
+	x.maxAge = maxAge
+	x.maxEntries = maxEntries
+	x.entries = map[string]map[string]entry{}
+	x.order = list.New()
+	x.elements = map[entryKey]*list.Element{}
+
+	err := x.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return x, nil
+}
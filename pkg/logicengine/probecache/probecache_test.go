@@ -0,0 +1,252 @@
+package probecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/logicengine/wildcardstruct"
+)
+
+func TestFingerprint(t *testing.T) {
+	config := wildcardstruct.DefaultProbeConfig()
+
+	adaptiveConfig := config
+	adaptiveConfig.Adaptive = true
+
+	ttlConfig := config
+	ttlConfig.MaxTTL = 0
+
+	tests := []struct {
+		name        string
+		resolvers   common.DNSServers
+		config      wildcardstruct.ProbeConfig
+		other       common.DNSServers
+		otherConfig wildcardstruct.ProbeConfig
+		wantEqual   bool
+	}{
+		{
+			name:        "Order doesn't matter",
+			resolvers:   common.DNSServers{"1.1.1.1", "8.8.8.8"},
+			config:      config,
+			other:       common.DNSServers{"8.8.8.8", "1.1.1.1"},
+			otherConfig: config,
+			wantEqual:   true,
+		},
+		{
+			name:        "Different resolvers",
+			resolvers:   common.DNSServers{"1.1.1.1", "8.8.8.8"},
+			config:      config,
+			other:       common.DNSServers{"1.1.1.1"},
+			otherConfig: config,
+			wantEqual:   false,
+		},
+		{
+			name:        "Different probe mode",
+			resolvers:   common.DNSServers{"1.1.1.1"},
+			config:      config,
+			other:       common.DNSServers{"1.1.1.1"},
+			otherConfig: adaptiveConfig,
+			wantEqual:   false,
+		},
+		{
+			name:        "TTL bounds don't matter",
+			resolvers:   common.DNSServers{"1.1.1.1"},
+			config:      config,
+			other:       common.DNSServers{"1.1.1.1"},
+			otherConfig: ttlConfig,
+			wantEqual:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Fingerprint(tt.resolvers, tt.config) == Fingerprint(tt.other, tt.otherConfig)
+			if got != tt.wantEqual {
+				t.Errorf("Fingerprint() equal = %v, want %v", got, tt.wantEqual)
+			}
+		})
+	}
+}
+
+func TestProbeCache_Save(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rand0m_tmp_*")
+	if err != nil {
+		t.Errorf("Save(): Encountered error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cache.json")
+
+	results := []common.DNSRecordSet{
+		{
+			{Name: "abc.example.com.", Type: common.TypeA, Value: "1.2.3.4"},
+		},
+		{},
+	}
+
+	// Missing file is an empty cache
+	cache, err := CreateProbeCacheInstance(path, "resolvers", time.Hour, 0)
+	if err != nil {
+		t.Errorf("CreateProbeCacheInstance() error = %v, wantErr %v", err, false)
+		return
+	}
+
+	cache.Set("example.com", results)
+
+	if err := cache.Save(); err != nil {
+		t.Errorf("Save() error = %v, wantErr %v", err, false)
+		return
+	}
+
+	tests := []struct {
+		name        string
+		fingerprint string
+		maxAge      time.Duration
+		domainName  string
+		wantFound   bool
+	}{
+		{
+			name:        "Same resolvers",
+			fingerprint: "resolvers",
+			maxAge:      time.Hour,
+			domainName:  "example.com.",
+			wantFound:   true,
+		},
+		{
+			name:        "No expiry",
+			fingerprint: "resolvers",
+			maxAge:      0,
+			domainName:  "example.com.",
+			wantFound:   true,
+		},
+		{
+			name:        "Other resolvers",
+			fingerprint: "other",
+			maxAge:      time.Hour,
+			domainName:  "example.com.",
+			wantFound:   false,
+		},
+		{
+			name:        "Expired",
+			fingerprint: "resolvers",
+			maxAge:      time.Nanosecond,
+			domainName:  "example.com.",
+			wantFound:   false,
+		},
+		{
+			name:        "Other domain",
+			fingerprint: "resolvers",
+			maxAge:      time.Hour,
+			domainName:  "sub.example.com.",
+			wantFound:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, err := CreateProbeCacheInstance(path, tt.fingerprint, tt.maxAge, 0)
+			if err != nil {
+				t.Errorf("CreateProbeCacheInstance() error = %v, wantErr %v", err, false)
+				return
+			}
+
+			got, _, found := cache.Get(tt.domainName)
+			if found != tt.wantFound {
+				t.Errorf("Get() found = %v, want %v", found, tt.wantFound)
+				return
+			}
+
+			if found && !reflect.DeepEqual(got, results) {
+				t.Errorf("Get() got = %v, want %v", got, results)
+			}
+		})
+	}
+}
+
+func TestCreateProbeCacheInstance_invalid(t *testing.T) {
+	cacheFile, err := ioutil.TempFile("", "rand0m_tmp_*")
+	if err != nil {
+		t.Errorf("CreateProbeCacheInstance(): Encountered error: %v", err)
+		return
+	}
+	defer os.Remove(cacheFile.Name())
+
+	_, err = cacheFile.Write([]byte("not json"))
+	if err != nil {
+		t.Errorf("CreateProbeCacheInstance(): Encountered error: %v", err)
+		return
+	}
+
+	_, err = CreateProbeCacheInstance(cacheFile.Name(), "resolvers", time.Hour, 0)
+	if err == nil {
+		t.Errorf("CreateProbeCacheInstance() error = %v, wantErr %v", err, true)
+	}
+}
+
+func TestProbeCache_maxEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rand0m_tmp_*")
+	if err != nil {
+		t.Errorf("Set(): Encountered error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cache.json")
+	results := []common.DNSRecordSet{{}}
+
+	cache, err := CreateProbeCacheInstance(path, "resolvers", time.Hour, 2)
+	if err != nil {
+		t.Errorf("CreateProbeCacheInstance() error = %v, wantErr %v", err, false)
+		return
+	}
+
+	for _, domainName := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		cache.Set(domainName, results)
+		// Distinct probe time for each entry
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := cache.Save(); err != nil {
+		t.Errorf("Save() error = %v, wantErr %v", err, false)
+		return
+	}
+
+	tests := []struct {
+		name       string
+		maxEntries int
+		want       map[string]bool
+	}{
+		{
+			name:       "Oldest probed entry is dropped",
+			maxEntries: 2,
+			want:       map[string]bool{"a.example.com.": false, "b.example.com.": true, "c.example.com.": true},
+		},
+		{
+			name:       "Smaller limit while loading",
+			maxEntries: 1,
+			want:       map[string]bool{"a.example.com.": false, "b.example.com.": false, "c.example.com.": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, err := CreateProbeCacheInstance(path, "resolvers", time.Hour, tt.maxEntries)
+			if err != nil {
+				t.Errorf("CreateProbeCacheInstance() error = %v, wantErr %v", err, false)
+				return
+			}
+
+			for domainName, wantFound := range tt.want {
+				if _, _, found := cache.Get(domainName); found != wantFound {
+					t.Errorf("Get(%s) found = %v, want %v", domainName, found, wantFound)
+				}
+			}
+		})
+	}
+}
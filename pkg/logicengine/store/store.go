@@ -1,21 +1,36 @@
 package store
 
 import (
+	"container/list"
 	"sync"
 
 	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/faizal3199/dns-wildcard-removal/pkg/logicengine/probecache"
 	"github.com/faizal3199/dns-wildcard-removal/pkg/logicengine/wildcardstruct"
 )
 
 /*
-Store caches WildcardDomain objects and exposes a thread safe function to access them
+Store caches WildcardDomain objects and exposes a thread safe function to access them. Least
+recently used objects are evicted once there are more than maxEntries objects.
 */
 type Store struct {
-	cache map[string]*wildcardstruct.WildcardDomain
-	mutex sync.Mutex
+	cache       map[string]*list.Element
+	lru         *list.List
+	maxEntries  int
+	probeConfig wildcardstruct.ProbeConfig
+	probeCache  *probecache.ProbeCache
+	mutex       sync.Mutex
+}
+
+/*
+storeEntry is the value of elements in lru list
+*/
+type storeEntry struct {
+	domainName string
+	object     *wildcardstruct.WildcardDomain
 }
 
 func (c *Store) lock() {
@@ -26,9 +41,37 @@ func (c *Store) unlock() {
 	c.mutex.Unlock()
 }
 
+/*
+createDomainObject returns a new domain object. Results from probe cache are used if present, until
+they expire as per the time they were probed at. Results are stored in probe cache each time they are
+fetched.
+*/
+func (c *Store) createDomainObject(lookupName string) *wildcardstruct.WildcardDomain {
+	if c.probeCache == nil {
+		return wildcardstruct.CreateWildcardDomainInstance(lookupName, c.probeConfig)
+	}
+
+	var newObject *wildcardstruct.WildcardDomain
+
+	if results, probedAt, ok := c.probeCache.Get(lookupName); ok {
+		log.Debugf("Using cached probe results for %s probed at %v", lookupName, probedAt)
+		newObject = wildcardstruct.CreateFetchedWildcardDomainInstance(lookupName, c.probeConfig, results,
+			probedAt)
+	} else {
+		newObject = wildcardstruct.CreateWildcardDomainInstance(lookupName, c.probeConfig)
+	}
+
+	newObject.NotifyOnFetch(func(results []common.DNSRecordSet) {
+		c.probeCache.Set(lookupName, results)
+	})
+
+	return newObject
+}
+
 /*
 GetOrCreateDomainObject returns the domain object is present in cache or creates and return
-the new object. created is true if new object is created otherwise false
+the new object. created is true if new object is created otherwise false. Probe cache, if any,
+is consulted before creating a new object.
 */
 func (c *Store) GetOrCreateDomainObject(domainName string) (value *wildcardstruct.WildcardDomain, created bool) {
 	defer c.unlock()
@@ -37,25 +80,61 @@ func (c *Store) GetOrCreateDomainObject(domainName string) (value *wildcardstruc
 	// Alter domain name to match valid format
 	lookupName := common.SanitizeDomainName(domainName)
 
-	cachedObject := c.cache[lookupName]
+	element := c.cache[lookupName]
 
-	if cachedObject == nil {
+	if element == nil {
 		log.Debugf("Creating new wildcardDomain Object for %s", lookupName)
-		newObject := wildcardstruct.CreateWildcardDomainInstance(lookupName)
+		newObject := c.createDomainObject(lookupName)
 
-		c.cache[lookupName] = newObject
+		c.cache[lookupName] = c.lru.PushFront(&storeEntry{domainName: lookupName, object: newObject})
+		c.evict()
 
 		return newObject, true
 	}
 
-	return cachedObject, false
+	c.lru.MoveToFront(element)
+
+	return element.Value.(*storeEntry).object, false
+}
+
+/*
+evict removes least recently used objects until there are at most maxEntries objects. Objects
+still being fetched are pinned, as there may be callers waiting on them. So the store can
+temporarily grow beyond maxEntries.
+*/
+func (c *Store) evict() {
+	if c.maxEntries <= 0 {
+		return
+	}
+
+	element := c.lru.Back()
+
+	for c.lru.Len() > c.maxEntries && element != nil {
+		prev := element.Prev()
+		entry := element.Value.(*storeEntry)
+
+		if entry.object.IsDone() {
+			log.Debugf("Evicting wildcardDomain Object for %s", entry.domainName)
+			c.lru.Remove(element)
+			delete(c.cache, entry.domainName)
+		}
+
+		element = prev
+	}
 }
 
 /*
-CreateStoreInstance returns a newly initialized store instance.
+CreateStoreInstance returns a newly initialized store instance. New domain objects are created
+using probeConfig. probeCache is optional, use nil to always probe. At most maxEntries objects
+are kept, use 0 for no limit.
 */
-func CreateStoreInstance() *Store {
+func CreateStoreInstance(probeConfig wildcardstruct.ProbeConfig, probeCache *probecache.ProbeCache,
+	maxEntries int) *Store {
 	x := new(Store)
-	x.cache = map[string]*wildcardstruct.WildcardDomain{}
+	x.cache = map[string]*list.Element{}
+	x.lru = list.New()
+	x.maxEntries = maxEntries
+	x.probeConfig = probeConfig
+	x.probeCache = probeCache
 	return x
 }
@@ -1,15 +1,24 @@
 package store
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/logicengine/probecache"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/logicengine/wildcardstruct"
 )
 
 func TestStore_GetOrCreateDomainObject(t *testing.T) {
 	t.Run("Verify store's cache", func(t *testing.T) {
 		DomainName := "xyz.com"
 
-		c := CreateStoreInstance()
+		c := CreateStoreInstance(wildcardstruct.DefaultProbeConfig(), nil, 0)
 		gotValue1, gotCreated1 := c.GetOrCreateDomainObject(DomainName)
 
 		if !gotCreated1 {
@@ -28,3 +37,119 @@ func TestStore_GetOrCreateDomainObject(t *testing.T) {
 		}
 	})
 }
+
+func TestStore_GetOrCreateDomainObject_probeCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rand0m_tmp_*")
+	if err != nil {
+		t.Errorf("GetOrCreateDomainObject(): Encountered error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	probeCache, err := probecache.CreateProbeCacheInstance(filepath.Join(dir, "cache.json"), "resolvers",
+		time.Hour, 0)
+	if err != nil {
+		t.Errorf("GetOrCreateDomainObject(): Encountered error: %v", err)
+		return
+	}
+
+	want := []common.DNSRecordSet{
+		{
+			{Name: "abc.xyz.com.", Type: common.TypeA, Value: "1.2.3.4"},
+		},
+	}
+	probeCache.Set("xyz.com", want)
+
+	c := CreateStoreInstance(wildcardstruct.DefaultProbeConfig(), probeCache, 0)
+	gotValue, _ := c.GetOrCreateDomainObject("xyz.com")
+
+	// Cached results are returned without probing, so no client is required
+	got, err := gotValue.GetResults(context.Background(), context.Background(), nil)
+	if err != nil {
+		t.Errorf("GetResults() error = %v, wantErr %v", err, false)
+		return
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetResults() got = %v, want %v", got, want)
+	}
+}
+
+func TestStore_GetOrCreateDomainObject_eviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rand0m_tmp_*")
+	if err != nil {
+		t.Errorf("GetOrCreateDomainObject(): Encountered error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	probeCache, err := probecache.CreateProbeCacheInstance(filepath.Join(dir, "cache.json"), "resolvers",
+		time.Hour, 0)
+	if err != nil {
+		t.Errorf("GetOrCreateDomainObject(): Encountered error: %v", err)
+		return
+	}
+
+	// Objects created from probe cache are already fetched
+	for _, domainName := range []string{"a.xyz.com", "b.xyz.com", "c.xyz.com"} {
+		probeCache.Set(domainName, []common.DNSRecordSet{})
+	}
+
+	tests := []struct {
+		name        string
+		probeCache  *probecache.ProbeCache
+		maxEntries  int
+		accesses    []string
+		lookup      string
+		wantCreated bool
+	}{
+		{
+			name:        "Least recently used is evicted",
+			probeCache:  probeCache,
+			maxEntries:  2,
+			accesses:    []string{"a.xyz.com", "b.xyz.com", "c.xyz.com"},
+			lookup:      "a.xyz.com",
+			wantCreated: true,
+		},
+		{
+			name:        "Recently used is kept",
+			probeCache:  probeCache,
+			maxEntries:  2,
+			accesses:    []string{"a.xyz.com", "b.xyz.com", "a.xyz.com", "c.xyz.com"},
+			lookup:      "a.xyz.com",
+			wantCreated: false,
+		},
+		{
+			name:        "No limit",
+			probeCache:  probeCache,
+			maxEntries:  0,
+			accesses:    []string{"a.xyz.com", "b.xyz.com", "c.xyz.com"},
+			lookup:      "a.xyz.com",
+			wantCreated: false,
+		},
+		{
+			// Objects never fetched are pinned
+			name:        "In-flight is pinned",
+			probeCache:  nil,
+			maxEntries:  1,
+			accesses:    []string{"a.xyz.com", "b.xyz.com"},
+			lookup:      "a.xyz.com",
+			wantCreated: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := CreateStoreInstance(wildcardstruct.DefaultProbeConfig(), tt.probeCache, tt.maxEntries)
+
+			for _, domainName := range tt.accesses {
+				c.GetOrCreateDomainObject(domainName)
+			}
+
+			_, gotCreated := c.GetOrCreateDomainObject(tt.lookup)
+			if gotCreated != tt.wantCreated {
+				t.Errorf("GetOrCreateDomainObject() gotCreated = %v, want %v", gotCreated, tt.wantCreated)
+			}
+		})
+	}
+}
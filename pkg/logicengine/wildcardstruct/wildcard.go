@@ -1,6 +1,7 @@
 package wildcardstruct
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"sync"
@@ -13,14 +14,45 @@ import (
 )
 
 /*
-WildcardDomain fetches and caches the result for random subdomains of a single parent domain
+WildcardDomain fetches and caches the result for random subdomains of a single parent domain. The
+result is fetched again once expired as per TTL of the records.
 */
 type WildcardDomain struct {
-	domainName  string
-	mutex       sync.RWMutex
+	domainName string
+	config     ProbeConfig
+	mutex      sync.Mutex
+	current    *fetch
+	onFetched  func([]common.DNSRecordSet)
+}
+
+/*
+fetch is a single round of probes. done is closed once the round is complete.
+*/
+type fetch struct {
+	done        chan struct{}
 	result      []common.DNSRecordSet
 	resolverErr error
-	fetched     bool
+	// expiresAt is zero if the result never expires
+	expiresAt time.Time
+}
+
+/*
+isDone returns true if the fetch is complete. It doesn't block.
+*/
+func (f *fetch) isDone() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+isExpired returns true if the fetch is complete and its result has expired
+*/
+func (f *fetch) isExpired() bool {
+	return f.isDone() && !f.expiresAt.IsZero() && time.Now().After(f.expiresAt)
 }
 
 const (
@@ -34,24 +66,78 @@ const (
 	// Doesn't use '-' as it can't be the first character in a label
 	ValidCharacters = "0123456789abcdefghijklmnopqrstuvwxyz"
 
-	// Number of times result will be fetched
-	numberOfTest = 10
+	// Adaptive mode: stop if these many first probes are NXDOMAIN
+	adaptiveNXProbes = 3
+
+	// Adaptive mode: stop if these many consecutive probes don't add a new value
+	adaptiveStableProbes = 3
 )
 
-func (d *WildcardDomain) lock() {
-	d.mutex.Lock()
+/*
+ProbeConfig controls how many random subdomains are probed for a parent domain
+*/
+type ProbeConfig struct {
+	// Count is the number of successful probes
+	Count int
+	// Adaptive enables early stop for NXDOMAIN parents and keeps sampling beyond Count
+	// while new values keep showing up
+	Adaptive bool
+	// MaxCount is the maximum number of successful probes in adaptive mode
+	MaxCount int
+	// MinTTL and MaxTTL bound the time for which results are used, based on lowest TTL of the
+	// records. Results without any record expire after MaxTTL. Results never expire if MaxTTL is 0
+	MinTTL time.Duration
+	MaxTTL time.Duration
 }
 
-func (d *WildcardDomain) unlock() {
-	d.mutex.Unlock()
+/*
+DefaultProbeConfig returns the ProbeConfig used when none is provided
+*/
+func DefaultProbeConfig() ProbeConfig {
+	return ProbeConfig{
+		Count:    10,
+		Adaptive: false,
+		MaxCount: 50,
+		MinTTL:   time.Minute,
+		MaxTTL:   time.Hour,
+	}
 }
 
-func (d *WildcardDomain) readLock() {
-	d.mutex.RLock()
+/*
+getMaxProbes returns the maximum number of successful probes
+*/
+func (c ProbeConfig) getMaxProbes() int {
+	if c.Adaptive && c.MaxCount > c.Count {
+		return c.MaxCount
+	}
+
+	return c.Count
 }
 
-func (d *WildcardDomain) readUnlock() {
-	d.mutex.RUnlock()
+/*
+getExpiry returns the time at which result probed at probedAt expires as per lowest TTL of the records.
+Zero time is returned if the results never expire.
+*/
+func (c ProbeConfig) getExpiry(result []common.DNSRecordSet, probedAt time.Time) time.Time {
+	if c.MaxTTL <= 0 {
+		return time.Time{}
+	}
+
+	ttl := c.MaxTTL
+
+	for _, recordSet := range result {
+		for _, record := range recordSet {
+			if recordTTL := time.Duration(record.TTL) * time.Second; recordTTL < ttl {
+				ttl = recordTTL
+			}
+		}
+	}
+
+	if ttl < c.MinTTL {
+		ttl = c.MinTTL
+	}
+
+	return probedAt.Add(ttl)
 }
 
 /*
@@ -77,78 +163,187 @@ func GetRandomSubdomain(domainName string) string {
 }
 
 /*
-fetchDNSRecordsInBackground acquires acquire write lock and then fetches DNS records in background.
-Lock is released when record are fetched. Returns any error occurred before fetching records
+fetchDNSRecords fetches DNS records for random subdomains into f and signals completion by closing
+f.done. Fetching stops with ctx.Err() as error if ctx is done, such a fetch is expired immediately.
+Results are reported to onFetched only if all the required probes succeeded, failed probes in
+between are retried with other random subdomains.
 */
-func (d *WildcardDomain) fetchDNSRecordsInBackground(resolvers common.DNSServers) {
-	d.lock()
+func (d *WildcardDomain) fetchDNSRecords(ctx context.Context, client *dnsengine.Client, f *fetch) {
+	defer close(f.done)
 
-	if d.fetched {
-		defer d.unlock()
-		return
-	}
+	maxProbes := d.config.getMaxProbes()
+	maxTests := maxProbes * 2
+
+	successCount := 0
+	// Adaptive mode may need fewer probes
+	sampled := false
+	nxCount := 0
+	probesWithoutNewValue := 0
+	seenValues := map[string]bool{}
+
+	for successCount < maxProbes && maxTests >= 0 {
+		// Avoid getting into infinite loop
+		maxTests--
 
-	func() {
-		defer d.unlock()
-
-		i := numberOfTest - 1
-		maxTests := numberOfTest * 2
-
-		for i >= 0 && maxTests >= 0 {
-			// Using random subdomains will also help avoid caching done by resolver
-			randomSubdomain := GetRandomSubdomain(d.domainName)
-			// Use all the resolvers to query the results instead of selecting a specific one.
-			// As, a random subdomain is used this will lead to a virtually no chance of caching
-			res, err := dnsengine.GetDNSRecords(resolvers, randomSubdomain)
-
-			log.Debugf("Got DNS records for %s\nsubdomain = %s\nerr = %v\nres = %v",
-				d.domainName, randomSubdomain, err, res)
-
-			if err == nil {
-				d.result = append(d.result, res)
-				i-- // Keep resolving until we get all the successful instances
-			} else {
-				log.Infof("Got error while resolving a subdomain of %s\nsubdomain = %s\nerr = %v",
-					d.domainName, randomSubdomain, err)
-				d.resolverErr = fmt.Errorf("error resolving: %s", d.domainName)
+		// Using random subdomains will also help avoid caching done by resolver
+		randomSubdomain := GetRandomSubdomain(d.domainName)
+		// Client rotates the resolvers for each query instead of selecting a specific one.
+		// As, a random subdomain is used this will lead to a virtually no chance of caching
+		res, err := client.ResolveDomain(ctx, randomSubdomain)
+
+		if ctx.Err() != nil {
+			f.resolverErr = ctx.Err()
+			f.expiresAt = time.Now()
+			return
+		}
+
+		log.Debugf("Got DNS records for %s\nsubdomain = %s\nerr = %v\nstatus = %v\nres = %v",
+			d.domainName, randomSubdomain, err, res.Status, res.Records)
+
+		if err != nil {
+			log.Infof("Got error while resolving a subdomain of %s\nsubdomain = %s\nerr = %v",
+				d.domainName, randomSubdomain, err)
+			f.resolverErr = fmt.Errorf("error resolving %s: %v", randomSubdomain, err)
+			continue
+		}
+
+		// Keep resolving until we get all the successful instances
+		f.result = append(f.result, res.Records)
+		successCount++
+
+		if !d.config.Adaptive {
+			continue
+		}
+
+		// Dangling CNAME wildcard replies NXDOMAIN along with the CNAME chain
+		if res.Status == dnsengine.StatusNXDomain && len(res.Records) == 0 {
+			nxCount++
+		}
+
+		// Parent without wildcard. No need to waste more probes
+		if successCount == adaptiveNXProbes && nxCount == successCount {
+			log.Debugf("Stopping probes for %s after %d NXDOMAIN replies", d.domainName, nxCount)
+			sampled = true
+			break
+		}
+
+		newValueFound := false
+		for _, record := range res.Records {
+			if !seenValues[record.Value] {
+				seenValues[record.Value] = true
+				newValueFound = true
 			}
+		}
+
+		if newValueFound {
+			probesWithoutNewValue = 0
+		} else {
+			probesWithoutNewValue++
+		}
 
-			// Avoid getting into infinite loop
-			maxTests--
+		// Pool of values stopped growing
+		if successCount >= d.config.Count && probesWithoutNewValue >= adaptiveStableProbes {
+			sampled = true
+			break
 		}
+	}
+
+	f.expiresAt = d.config.getExpiry(f.result, time.Now())
 
-		d.fetched = true
-	}()
+	// Partial results aren't reported
+	if (sampled || successCount >= maxProbes) && d.onFetched != nil {
+		d.onFetched(f.result)
+	}
 }
 
 /*
-GetResults checks if records are already fetched if so return else call fetchDNSRecordsInBackground
-to fetch records and then recursively call GetResults. GetResults acquires read lock before checking
-in cache
+IsDone returns true if the latest fetch is complete or stopped. It doesn't block.
 */
-func (d *WildcardDomain) GetResults(resolver common.DNSServers) ([]common.DNSRecordSet, error) {
-	d.readLock()
+func (d *WildcardDomain) IsDone() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.current != nil && d.current.isDone()
+}
 
-	if d.fetched {
-		defer d.readUnlock()
-		return d.result, d.resolverErr
+/*
+NotifyOnFetch sets f to be called with the results each time all the required probes succeed. It
+must be called before the first call to GetResults.
+*/
+func (d *WildcardDomain) NotifyOnFetch(f func([]common.DNSRecordSet)) {
+	d.onFetched = f
+}
+
+/*
+newFetch returns a fetch yet to be started
+*/
+func newFetch() *fetch {
+	return &fetch{
+		done:   make(chan struct{}),
+		result: make([]common.DNSRecordSet, 0),
 	}
+}
+
+/*
+GetResults starts fetching the records on first call or once the results have expired, and waits until
+they are fetched or ctx is done. Concurrent callers share the same fetch, which runs under fetchCtx
+e.g. lifetime of the pipeline, not ctx of any caller. So cancelling ctx only stops the wait of that
+caller.
+*/
+func (d *WildcardDomain) GetResults(ctx context.Context, fetchCtx context.Context,
+	client *dnsengine.Client) ([]common.DNSRecordSet, error) {
+	d.mutex.Lock()
 
-	d.readUnlock()
-	d.fetchDNSRecordsInBackground(resolver)
+	if d.current == nil || d.current.isExpired() {
+		if d.current != nil {
+			log.Debugf("Probe results expired for %s. Probing again", d.domainName)
+		}
+
+		d.current = newFetch()
+		go d.fetchDNSRecords(fetchCtx, client, d.current)
+	}
+
+	f := d.current
+	d.mutex.Unlock()
 
-	// Allow the fetchDNSRecordsInBackground goroutine to start
-	time.Sleep(time.Second)
-	return d.GetResults(resolver)
+	select {
+	case <-f.done:
+		return f.result, f.resolverErr
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 /*
 CreateWildcardDomainInstance returns newly initialized WildcardDomain instance. It changes the
 domainName for returned WildcardDomain object to a likely non-existence subdomain of provided domain.
+config controls the number of random subdomains probed and expiry of the results.
 */
-func CreateWildcardDomainInstance(domainName string) *WildcardDomain {
+func CreateWildcardDomainInstance(domainName string, config ProbeConfig) *WildcardDomain {
 	x := new(WildcardDomain)
 	x.domainName = common.SanitizeDomainName(domainName)
-	x.result = make([]common.DNSRecordSet, 0)
+	x.config = config
+	return x
+}
+
+/*
+CreateFetchedWildcardDomainInstance returns a WildcardDomain instance with results already fetched at
+probedAt e.g. by an earlier run. GetResults returns the results without probing until they expire.
+Expiry is counted from probedAt, so results which have already expired are ignored and probed again.
+*/
+func CreateFetchedWildcardDomainInstance(domainName string, config ProbeConfig,
+	result []common.DNSRecordSet, probedAt time.Time) *WildcardDomain {
+	x := CreateWildcardDomainInstance(domainName, config)
+
+	expiresAt := config.getExpiry(result, probedAt)
+	if !expiresAt.IsZero() && time.Now().After(expiresAt) {
+		return x
+	}
+
+	x.current = newFetch()
+	x.current.result = result
+	x.current.expiresAt = expiresAt
+	close(x.current.done)
+
 	return x
 }
@@ -1,12 +1,60 @@
 package wildcardstruct
 
 import (
+	"context"
+	"net"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
 
 	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/dnsengine"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/ratelimit"
 )
 
+/*
+startTestServer starts a local DNS server over TCP and returns a client using it as per config. The
+server replies NXDOMAIN if nxdomain is set, otherwise same A record for each name. queryCount, if not
+nil, is incremented for each query.
+*/
+func startTestServer(nxdomain bool, queryCount *int32, config dnsengine.Config) (*dnsengine.Client,
+	func() error, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	server := &dns.Server{
+		Listener: listener,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			if queryCount != nil {
+				atomic.AddInt32(queryCount, 1)
+			}
+
+			reply := new(dns.Msg)
+			reply.SetReply(req)
+
+			if nxdomain {
+				reply.Rcode = dns.RcodeNameError
+			} else if req.Question[0].Qtype == dns.TypeA {
+				rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+				reply.Answer = append(reply.Answer, rr)
+			}
+
+			_ = w.WriteMsg(reply)
+		}),
+	}
+	go func() { _ = server.ActivateAndServe() }()
+
+	client := dnsengine.CreateClientInstance(common.DNSServers{"tcp://" + listener.Addr().String()}, config)
+
+	return client, server.Shutdown, nil
+}
+
 func Test_wildcardDomain_GetResults(t *testing.T) {
 	type fields struct {
 		DomainName string
@@ -48,9 +96,11 @@ func Test_wildcardDomain_GetResults(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			d := CreateWildcardDomainInstance(tt.fields.DomainName)
+			d := CreateWildcardDomainInstance(tt.fields.DomainName, DefaultProbeConfig())
 
-			got, err := d.GetResults(tt.args.resolver)
+			client := dnsengine.CreateClientInstance(tt.args.resolver, dnsengine.DefaultConfig())
+
+			got, err := d.GetResults(context.Background(), context.Background(), client)
 
 			// Modify to match random domain name
 			want := make([]common.DNSRecordSet, 0)
@@ -68,8 +118,8 @@ func Test_wildcardDomain_GetResults(t *testing.T) {
 				return
 			}
 
-			if len(got) != numberOfTest {
-				t.Errorf("GetResults() len(got) = %d, len(want) %d", len(got), numberOfTest)
+			if len(got) != DefaultProbeConfig().Count {
+				t.Errorf("GetResults() len(got) = %d, len(want) %d", len(got), DefaultProbeConfig().Count)
 			}
 
 			if !reflect.DeepEqual(got, want) {
@@ -78,3 +128,352 @@ func Test_wildcardDomain_GetResults(t *testing.T) {
 		})
 	}
 }
+
+func Test_wildcardDomain_GetResults_probeConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    ProbeConfig
+		nxdomain  bool
+		wantCount int
+	}{
+		{
+			name:      "Fixed count",
+			config:    ProbeConfig{Count: 5, Adaptive: false, MaxCount: 50},
+			nxdomain:  true,
+			wantCount: 5,
+		},
+		{
+			name:      "Adaptive stops early on NXDOMAIN",
+			config:    ProbeConfig{Count: 5, Adaptive: true, MaxCount: 50},
+			nxdomain:  true,
+			wantCount: adaptiveNXProbes,
+		},
+		{
+			name:      "Adaptive stops when no new value shows up",
+			config:    ProbeConfig{Count: 5, Adaptive: true, MaxCount: 50},
+			nxdomain:  false,
+			wantCount: 5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, shutdown, err := startTestServer(tt.nxdomain, nil, dnsengine.DefaultConfig())
+			if err != nil {
+				t.Errorf("GetResults(): Encountered error: %v", err)
+				return
+			}
+			defer shutdown()
+
+			d := CreateWildcardDomainInstance("example.com.", tt.config)
+
+			got, err := d.GetResults(context.Background(), context.Background(), client)
+			if err != nil {
+				t.Errorf("GetResults() error = %v, wantErr %v", err, false)
+				return
+			}
+
+			if len(got) != tt.wantCount {
+				t.Errorf("GetResults() len(got) = %d, len(want) %d", len(got), tt.wantCount)
+			}
+		})
+	}
+}
+
+func Test_wildcardDomain_GetResults_concurrent(t *testing.T) {
+	var queryCount int32
+
+	client, shutdown, err := startTestServer(false, &queryCount, dnsengine.DefaultConfig())
+	if err != nil {
+		t.Errorf("GetResults(): Encountered error: %v", err)
+		return
+	}
+	defer shutdown()
+
+	config := DefaultProbeConfig()
+	d := CreateWildcardDomainInstance("example.com.", config)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			got, err := d.GetResults(context.Background(), context.Background(), client)
+			if err != nil {
+				t.Errorf("GetResults() error = %v, wantErr %v", err, false)
+				return
+			}
+
+			if len(got) != config.Count {
+				t.Errorf("GetResults() len(got) = %d, len(want) %d", len(got), config.Count)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("GetResults() took %v, want less than %v", elapsed, time.Second)
+	}
+
+	// A and AAAA query for each probe, fetched only once
+	if got, want := atomic.LoadInt32(&queryCount), int32(config.Count*2); got != want {
+		t.Errorf("GetResults() queries = %d, want %d", got, want)
+	}
+}
+
+func Test_wildcardDomain_GetResults_cancelled(t *testing.T) {
+	// Nothing listens on this address, so the fetch can't finish before ctx is cancelled
+	client := dnsengine.CreateClientInstance(common.DNSServers{"127.0.0.1"}, dnsengine.DefaultConfig())
+	d := CreateWildcardDomainInstance("example.com.", DefaultProbeConfig())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	got, err := d.GetResults(ctx, context.Background(), client)
+	if err != context.Canceled {
+		t.Errorf("GetResults() error = %v, want %v", err, context.Canceled)
+	}
+
+	if got != nil {
+		t.Errorf("GetResults() got = %v, want %v", got, nil)
+	}
+}
+
+func Test_wildcardDomain_GetResults_callerCancelled(t *testing.T) {
+	config := dnsengine.DefaultConfig()
+	// A and AAAA query for each probe take 1s
+	config.Limiter = ratelimit.CreateLimiterInstance(DefaultProbeConfig().Count * 2)
+
+	client, shutdown, err := startTestServer(false, nil, config)
+	if err != nil {
+		t.Errorf("GetResults(): Encountered error: %v", err)
+		return
+	}
+	defer shutdown()
+
+	d := CreateWildcardDomainInstance("example.com.", DefaultProbeConfig())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// Caller starting the fetch gives up
+	_, err = d.GetResults(ctx, context.Background(), client)
+	if err != context.DeadlineExceeded {
+		t.Errorf("GetResults() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Shared fetch isn't affected
+	got, err := d.GetResults(context.Background(), context.Background(), client)
+	if err != nil {
+		t.Errorf("GetResults() error = %v, wantErr %v", err, false)
+		return
+	}
+
+	if len(got) != DefaultProbeConfig().Count {
+		t.Errorf("GetResults() len(got) = %d, len(want) %d", len(got), DefaultProbeConfig().Count)
+	}
+}
+
+func Test_wildcardDomain_NotifyOnFetch(t *testing.T) {
+	client, shutdown, err := startTestServer(false, nil, dnsengine.DefaultConfig())
+	if err != nil {
+		t.Errorf("NotifyOnFetch(): Encountered error: %v", err)
+		return
+	}
+	defer shutdown()
+
+	d := CreateWildcardDomainInstance("example.com.", DefaultProbeConfig())
+
+	var notified []common.DNSRecordSet
+	d.NotifyOnFetch(func(results []common.DNSRecordSet) {
+		notified = results
+	})
+
+	got, err := d.GetResults(context.Background(), context.Background(), client)
+	if err != nil {
+		t.Errorf("GetResults() error = %v, wantErr %v", err, false)
+		return
+	}
+
+	if !reflect.DeepEqual(notified, got) {
+		t.Errorf("NotifyOnFetch() got = %v, want %v", notified, got)
+	}
+}
+
+func Test_wildcardDomain_NotifyOnFetch_failedProbes(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NotifyOnFetch(): Encountered error: %v", err)
+		return
+	}
+
+	var queryCount int32
+
+	// Every third query fails
+	server := &dns.Server{
+		Listener: listener,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			reply := new(dns.Msg)
+			reply.SetReply(req)
+
+			if atomic.AddInt32(&queryCount, 1)%3 == 0 {
+				reply.Rcode = dns.RcodeServerFailure
+			} else if req.Question[0].Qtype == dns.TypeA {
+				rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+				reply.Answer = append(reply.Answer, rr)
+			}
+
+			_ = w.WriteMsg(reply)
+		}),
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	defer server.Shutdown()
+
+	config := dnsengine.DefaultConfig()
+	config.Retries = 0
+
+	client := dnsengine.CreateClientInstance(common.DNSServers{"tcp://" + listener.Addr().String()}, config)
+	d := CreateWildcardDomainInstance("example.com.", DefaultProbeConfig())
+
+	var notified []common.DNSRecordSet
+	d.NotifyOnFetch(func(results []common.DNSRecordSet) {
+		notified = results
+	})
+
+	got, err := d.GetResults(context.Background(), context.Background(), client)
+	if err == nil {
+		t.Errorf("GetResults() error = %v, wantErr %v", err, true)
+	}
+
+	// Failed probes are replaced, so the sample is complete
+	if len(got) != DefaultProbeConfig().Count {
+		t.Errorf("GetResults() len(got) = %d, len(want) %d", len(got), DefaultProbeConfig().Count)
+	}
+
+	if !reflect.DeepEqual(notified, got) {
+		t.Errorf("NotifyOnFetch() got = %v, want %v", notified, got)
+	}
+}
+
+func Test_wildcardDomain_GetResults_expiry(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      ProbeConfig
+		wantQueries int32
+	}{
+		{
+			// Test server replies with TTL of 60s, so MaxTTL applies
+			name:        "Expired results are probed again",
+			config:      ProbeConfig{Count: 2, MinTTL: 0, MaxTTL: 50 * time.Millisecond},
+			wantQueries: 8,
+		},
+		{
+			name:        "Results never expire",
+			config:      ProbeConfig{Count: 2, MinTTL: 0, MaxTTL: 0},
+			wantQueries: 4,
+		},
+		{
+			name:        "Results used for lowest TTL",
+			config:      ProbeConfig{Count: 2, MinTTL: 0, MaxTTL: time.Hour},
+			wantQueries: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queryCount int32
+
+			client, shutdown, err := startTestServer(false, &queryCount, dnsengine.DefaultConfig())
+			if err != nil {
+				t.Errorf("GetResults(): Encountered error: %v", err)
+				return
+			}
+			defer shutdown()
+
+			d := CreateWildcardDomainInstance("example.com.", tt.config)
+
+			for i := 0; i < 2; i++ {
+				got, err := d.GetResults(context.Background(), context.Background(), client)
+				if err != nil {
+					t.Errorf("GetResults() error = %v, wantErr %v", err, false)
+					return
+				}
+
+				if len(got) != tt.config.Count {
+					t.Errorf("GetResults() len(got) = %d, len(want) %d", len(got), tt.config.Count)
+				}
+
+				time.Sleep(100 * time.Millisecond)
+			}
+
+			// A and AAAA query for each probe
+			if got := atomic.LoadInt32(&queryCount); got != tt.wantQueries {
+				t.Errorf("GetResults() queries = %d, want %d", got, tt.wantQueries)
+			}
+		})
+	}
+}
+
+func TestCreateFetchedWildcardDomainInstance(t *testing.T) {
+	cached := []common.DNSRecordSet{
+		{
+			{Name: "abc.example.com.", Type: common.TypeA, Value: "5.6.7.8", TTL: 3600},
+		},
+	}
+
+	config := ProbeConfig{Count: 2, MinTTL: 0, MaxTTL: time.Hour}
+
+	tests := []struct {
+		name        string
+		probedAt    time.Time
+		wantCached  bool
+		wantQueries int32
+	}{
+		{
+			name:        "Fresh results",
+			probedAt:    time.Now().Add(-30 * time.Minute),
+			wantCached:  true,
+			wantQueries: 0,
+		},
+		{
+			name:        "Expired results",
+			probedAt:    time.Now().Add(-2 * time.Hour),
+			wantCached:  false,
+			wantQueries: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queryCount int32
+
+			client, shutdown, err := startTestServer(false, &queryCount, dnsengine.DefaultConfig())
+			if err != nil {
+				t.Errorf("GetResults(): Encountered error: %v", err)
+				return
+			}
+			defer shutdown()
+
+			d := CreateFetchedWildcardDomainInstance("example.com.", config, cached, tt.probedAt)
+
+			got, err := d.GetResults(context.Background(), context.Background(), client)
+			if err != nil {
+				t.Errorf("GetResults() error = %v, wantErr %v", err, false)
+				return
+			}
+
+			if gotCached := reflect.DeepEqual(got, cached); gotCached != tt.wantCached {
+				t.Errorf("GetResults() got = %v, cached %v", got, cached)
+			}
+
+			// A and AAAA query for each probe
+			if got := atomic.LoadInt32(&queryCount); got != tt.wantQueries {
+				t.Errorf("GetResults() queries = %d, want %d", got, tt.wantQueries)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package massdns
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -9,94 +11,123 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/ratelimit"
 )
 
-/*
-generateCannotOpenFileError generates an error using predefined template "cannot open file: %s"
-*/
-func generateCannotOpenFileError(path string) error {
-	return fmt.Errorf("cannot open file: %s", path)
-}
+// Record types queried by massdns for each domain
+var recordTypes = []common.RecordTypeType{common.TypeA, common.TypeAAAA}
 
 /*
-checkIfFileIsOkay performs following checks
-1) File exists
-2) Not a directory
+pipeInputWithRateLimit copies the input to writer line by line. Each line is written only after
+limiter allows a query for each of the record types, so massdns is bound by the same rate limit.
+massdns has no rate option, so its retries aren't limited i.e. the limit is on names fed to it
+rather than the queries sent. Copying stops with ctx.Err() if ctx is done.
 */
-func checkIfFileIsOkay(filePath string) bool {
-	fInfo, err := os.Stat(filePath)
-
-	if os.IsNotExist(err) {
-		return false
+func pipeInputWithRateLimit(ctx context.Context, writer io.Writer, reader io.Reader, limiter *ratelimit.Limiter) error {
+	scanner := bufio.NewScanner(reader)
+
+	for scanner.Scan() {
+		for range recordTypes {
+			if err := limiter.Wait(ctx); err != nil {
+				return err
+			}
+		}
+
+		_, err := writer.Write([]byte(scanner.Text() + "\n"))
+		if err != nil {
+			return err
+		}
 	}
 
-	if fInfo.IsDir() {
-		return false
-	}
-
-	return true
+	return scanner.Err()
 }
 
 /*
-getInputFile check the file for given path and
-if valid returns pointer to os.File object for that file
+StartMassdnsProcess starts the massdns process in new goroutine. Returns the pointer
+to output file object. Input is fed to massdns as allowed by limiter, nil means no limit.
+The process is killed if ctx is done before it exits. If massdns exits ungracefully or input
+can't be fed to it, reading the output returns the error after the last record.
 */
-func getInputFile(path string) (*os.File, error) {
-	if path == "-" {
-		return os.Stdin, nil
+func StartMassdnsProcess(ctx context.Context, inputFile string, resolverFile string,
+	limiter *ratelimit.Limiter) (*io.PipeReader, error) {
+	if !common.CheckIfFileIsOkay(resolverFile) {
+		err := common.GenerateCannotOpenFileError(resolverFile)
+		return nil, err
 	}
 
-	if checkIfFileIsOkay(path) {
-		fileObj, err := os.Open(path)
-		return fileObj, err
+	fileObj, err := common.GetInputFile(inputFile)
+	if err != nil {
+		return nil, err
 	}
-	return nil, generateCannotOpenFileError(path)
-
-}
 
-/*
-StartMassdnsProcess starts the massdns process in new goroutine. Returns the pointer
-to output file object.
-*/
-func StartMassdnsProcess(inputFile string, resolverFile string) (*io.PipeReader, error) {
-	if !checkIfFileIsOkay(resolverFile) {
-		err := generateCannotOpenFileError(resolverFile)
-		return nil, err
+	args := []string{"-r", resolverFile}
+	for _, recordType := range recordTypes {
+		args = append(args, "-t", recordType)
 	}
+	// TTL is included as 'name TTL class type value'
+	args = append(args, "-o", "Snlt", "--flush", "-")
 
-	cmd := exec.Command("massdns", "-r", resolverFile, "-t", "A", "-o", "Snl", "--flush", "-")
+	cmd := exec.CommandContext(ctx, "massdns", args...)
 
 	stdinPipe, err := cmd.StdinPipe()
 	if err != nil {
+		fileObj.Close()
 		return nil, err
 	}
 
 	pipeRead, pipeWrite := io.Pipe()
 	cmd.Stdout = pipeWrite
 
+	err = cmd.Start()
+	if err != nil {
+		fileObj.Close()
+		return nil, err
+	}
+
+	// Receives exactly one value once the input is fed
+	inputErrChan := make(chan error, 1)
+
 	go func() {
+		// Closing stdin signals massdns to finish
 		defer stdinPipe.Close()
-		fileObj, err := getInputFile(inputFile)
 
-		common.FailOnError(err, fmt.Sprintf("Cannot open file: %s", inputFile))
+		if fileObj != os.Stdin {
+			defer fileObj.Close()
+		}
 
-		_, err = io.Copy(stdinPipe, fileObj)
-		common.FailOnError(err, "Failed to pipe input to massdns")
-	}()
+		var err error
 
-	err = cmd.Start()
-	if err != nil {
-		return nil, err
-	}
+		if limiter == nil {
+			_, err = io.Copy(stdinPipe, fileObj)
+		} else {
+			err = pipeInputWithRateLimit(ctx, stdinPipe, fileObj, limiter)
+		}
+
+		if err != nil {
+			err = fmt.Errorf("failed to pipe input to massdns: %v", err)
+		}
+
+		inputErrChan <- err
+	}()
 
 	go func() {
-		err = cmd.Wait()
-		common.FailOnError(err, "massdns exited ungracefully")
-		log.Infoln("massdns command successfully executed")
+		err := cmd.Wait()
+
+		switch {
+		case ctx.Err() != nil:
+			log.Infoln("massdns process stopped")
+			err = nil
+		case err != nil:
+			// Input may still be blocked on reading, so don't wait for it
+			err = fmt.Errorf("massdns exited ungracefully: %v", err)
+		default:
+			log.Infoln("massdns command successfully executed")
+			err = <-inputErrChan
+		}
 
-		err = pipeWrite.Close()
-		common.FailOnError(err, "Failed to close massdns output pipe")
 		log.Infoln("Closing massdns output pipe")
+		// Error is returned to the reader once all the output is read
+		_ = pipeWrite.CloseWithError(err)
 	}()
 
 	return pipeRead, nil
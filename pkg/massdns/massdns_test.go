@@ -2,13 +2,16 @@ package massdns
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"os"
 	"os/exec"
-	"reflect"
-	"runtime"
+	"sort"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/ratelimit"
 )
 
 /*
@@ -32,6 +35,27 @@ func writeToTempFileAndLogErr(data string, t *testing.T) (inputFile *os.File, er
 	return
 }
 
+/*
+sortReplyBlocks sorts the blank line separated blocks of massdns output. TTL of the records is
+replaced by "TTL" as it counts down in resolver's cache.
+*/
+func sortReplyBlocks(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+
+	for i, line := range lines {
+		// name TTL class type value
+		if parts := strings.Split(line, " "); len(parts) == 5 {
+			parts[1] = "TTL"
+			lines[i] = strings.Join(parts, " ")
+		}
+	}
+
+	blocks := strings.Split(strings.Join(lines, "\n"), "\n\n")
+	sort.Strings(blocks)
+
+	return strings.Join(blocks, "\n\n")
+}
+
 func TestStartMassdnsProcess(t *testing.T) {
 	_, err := exec.LookPath("massdns")
 	if err != nil {
@@ -39,8 +63,13 @@ func TestStartMassdnsProcess(t *testing.T) {
 	}
 	t.Parallel()
 
-	expectedOutput := "cname.dns-test.faizalhasanwala.me. CNAME a.root-servers.net.\n"
-	expectedOutput += "a.root-servers.net. A 198.41.0.4\n"
+	// A and AAAA replies are separate blocks and massdns doesn't guarantee their order. Records are
+	// 'name TTL class type value' with -o Snlt
+	expectedOutput := "cname.dns-test.faizalhasanwala.me. TTL IN CNAME a.root-servers.net.\n"
+	expectedOutput += "a.root-servers.net. TTL IN A 198.41.0.4\n"
+	expectedOutput += "\n"
+	expectedOutput += "cname.dns-test.faizalhasanwala.me. TTL IN CNAME a.root-servers.net.\n"
+	expectedOutput += "a.root-servers.net. TTL IN AAAA 2001:503:ba3e::2:30\n"
 	expectedOutput += "\n"
 
 	t.Run("Check output: immediate", func(t *testing.T) {
@@ -56,7 +85,7 @@ func TestStartMassdnsProcess(t *testing.T) {
 		}
 		defer os.Remove(resolverFile.Name())
 
-		outputFile, _ := StartMassdnsProcess(inputFile.Name(), resolverFile.Name())
+		outputFile, _ := StartMassdnsProcess(context.Background(), inputFile.Name(), resolverFile.Name(), nil)
 		buff := new(bytes.Buffer)
 
 		_, err = buff.ReadFrom(outputFile)
@@ -67,7 +96,7 @@ func TestStartMassdnsProcess(t *testing.T) {
 
 		output := buff.String()
 
-		if output != expectedOutput {
+		if sortReplyBlocks(output) != sortReplyBlocks(expectedOutput) {
 			t.Errorf("StartMassdnsProcess() got = `\n%s\n`, want `\n%s\n`", output, expectedOutput)
 		}
 	})
@@ -85,7 +114,7 @@ func TestStartMassdnsProcess(t *testing.T) {
 		}
 		defer os.Remove(resolverFile.Name())
 
-		outputFile, _ := StartMassdnsProcess(inputFile.Name(), resolverFile.Name())
+		outputFile, _ := StartMassdnsProcess(context.Background(), inputFile.Name(), resolverFile.Name(), nil)
 
 		time.Sleep(3 * time.Second)
 
@@ -99,7 +128,7 @@ func TestStartMassdnsProcess(t *testing.T) {
 
 		output := buff.String()
 
-		if output != expectedOutput {
+		if sortReplyBlocks(output) != sortReplyBlocks(expectedOutput) {
 			t.Errorf("StartMassdnsProcess() got = `\n%s\n`, want `\n%s\n`", output, expectedOutput)
 		}
 
@@ -129,7 +158,7 @@ func TestStartMassdnsProcess(t *testing.T) {
 		defer func() { os.Stdin = oldStdin }()
 		os.Stdin = inputFile
 
-		outputFile, _ := StartMassdnsProcess("-", resolverFile.Name())
+		outputFile, _ := StartMassdnsProcess(context.Background(), "-", resolverFile.Name(), nil)
 
 		buff := new(bytes.Buffer)
 
@@ -141,7 +170,7 @@ func TestStartMassdnsProcess(t *testing.T) {
 
 		output := buff.String()
 
-		if output != expectedOutput {
+		if sortReplyBlocks(output) != sortReplyBlocks(expectedOutput) {
 			t.Errorf("StartMassdnsProcess() got = `\n%s\n`, want `\n%s\n`", output, expectedOutput)
 		}
 
@@ -153,151 +182,37 @@ func TestStartMassdnsProcess(t *testing.T) {
 	})
 }
 
-func Test_checkIfFileIsOkay(t *testing.T) {
-	type args struct {
-		filePath string
-	}
+func Test_sortReplyBlocks(t *testing.T) {
+	output := "b.example.com. 299 IN A 1.2.3.4\n\na.example.com. 60 IN A 1.2.3.4\n\n"
+	want := "a.example.com. TTL IN A 1.2.3.4\n\nb.example.com. TTL IN A 1.2.3.4"
 
-	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
-		t.Skip("Skipping in windows")
-	}
-
-	tests := []struct {
-		name string
-		args args
-		want bool
-	}{
-		{
-			name: "Non Existent file/directory",
-			args: args{
-				filePath: "/xyz/abc",
-			},
-			want: false,
-		},
-		{
-			name: "Existent Directory",
-			args: args{
-				filePath: "/",
-			},
-			want: false,
-		},
-		{
-			name: "Existent file",
-			args: args{
-				filePath: "/etc/hosts",
-			},
-			want: true,
-		},
-		{
-			name: "Existent unreadable file",
-			args: args{
-				filePath: "/etc/shadow",
-			},
-			want: true,
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if got := checkIfFileIsOkay(tt.args.filePath); got != tt.want {
-				t.Errorf("checkIfFileIsOkay() = %v, want %v", got, tt.want)
-			}
-		})
+	if got := sortReplyBlocks(output); got != want {
+		t.Errorf("sortReplyBlocks() = %v, want %v", got, want)
 	}
 }
 
-func Test_generateCannotOpenFileError(t *testing.T) {
-	type args struct {
-		path string
-	}
-	tests := []struct {
-		name    string
-		args    args
-		wantErr bool
-	}{
-		{
-			name: "Any input",
-			args: args{
-				path: "*",
-			},
-			wantErr: true,
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if err := generateCannotOpenFileError(tt.args.path); (err != nil) != tt.wantErr {
-				t.Errorf("generateCannotOpenFileError() error = %v, wantErr %v", err, tt.wantErr)
-			}
-		})
-	}
-}
+func Test_pipeInputWithRateLimit(t *testing.T) {
+	input := "a.example.com\nb.example.com\n"
+	output := new(bytes.Buffer)
 
-func Test_getInputFile(t *testing.T) {
-	type args struct {
-		path string
-	}
+	// 2 record types per line
+	limiter := ratelimit.CreateLimiterInstance(20)
 
-	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
-		t.Skip("Skipping in windows")
+	start := time.Now()
+	err := pipeInputWithRateLimit(context.Background(), output, strings.NewReader(input), limiter)
+	elapsed := time.Since(start)
+
+	if err != nil {
+		t.Errorf("pipeInputWithRateLimit() error = %v, wantErr %v", err, false)
+		return
 	}
 
-	tests := []struct {
-		name     string
-		args     args
-		wantPath string
-		wantErr  bool
-	}{
-		{
-			name: "Input file: /etc/hosts",
-			args: args{
-				path: "/etc/hosts",
-			},
-			wantPath: "/etc/hosts",
-			wantErr:  false,
-		},
-		{
-			name: "Input file: stdin",
-			args: args{
-				path: "-",
-			},
-			wantPath: "-",
-			wantErr:  false,
-		},
-		{
-			name: "Input file: directory",
-			args: args{
-				path: "/",
-			},
-			wantPath: "/",
-			wantErr:  true,
-		},
+	if output.String() != input {
+		t.Errorf("pipeInputWithRateLimit() wrote = %v, want %v", output.String(), input)
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got, err := getInputFile(tt.args.path)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("getInputFile() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-
-			if tt.wantErr {
-				return
-			}
-
-			var want *os.File
-
-			if tt.wantPath == "-" {
-				want = os.Stdin
-			} else {
-				want, _ = os.Open(tt.wantPath)
-			}
-
-			gotStat, _ := got.Stat()
-			wantStat, _ := want.Stat()
-
-			if !reflect.DeepEqual(gotStat, wantStat) {
-				t.Errorf("getInputFile() = %v, want %v", gotStat, wantStat)
-			}
-		})
+	// First query is immediate, next 3 are 50ms apart
+	if elapsed < 150*time.Millisecond {
+		t.Errorf("pipeInputWithRateLimit() took %v, want at least %v", elapsed, 150*time.Millisecond)
 	}
 }
@@ -0,0 +1,147 @@
+package native
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/dnsengine"
+)
+
+/*
+resolveWorker resolves the domains received on domainChan and publishes the records on the
+channel `c`. Domains without any record or failed lookups are dropped, same as massdns does.
+*/
+func resolveWorker(ctx context.Context,
+	client *dnsengine.Client,
+	domainChan <-chan common.DomainType,
+	c chan<- common.DomainRecords,
+	wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+
+	for domain := range domainChan {
+		records, err := client.GetDNSRecords(ctx, domain)
+
+		// Keep draining domainChan until the reader stops
+		if ctx.Err() != nil {
+			continue
+		}
+
+		if err != nil {
+			log.Debugf("Failed to resolve %s: %v", domain, err)
+			continue
+		}
+
+		if len(records) == 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+		case c <- common.DomainRecords{DomainName: domain, Records: records}:
+		}
+	}
+}
+
+/*
+ReadDomains reads one domain per line from reader and sends them on domainChan. Empty lines are
+skipped. Function closes domainChan once the input is exhausted or ctx is done. Returns the error
+encountered while reading, if any.
+*/
+func ReadDomains(ctx context.Context, reader io.Reader, domainChan chan<- common.DomainType) error {
+	defer close(domainChan)
+
+	scanner := bufio.NewScanner(reader)
+	readDomainsCount := 0
+
+readLoop:
+	for scanner.Scan() {
+		domain := common.SanitizeDomainName(scanner.Text())
+
+		// Skip empty lines
+		if domain == "." {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Infoln("Reading input cancelled")
+			break readLoop
+		case domainChan <- domain:
+		}
+		readDomainsCount++
+
+		if readDomainsCount%10000 == 0 {
+			log.Infof("Number of domains sent for resolution until now: %d", readDomainsCount)
+		}
+	}
+
+	log.Infof("Number of domains read from input: %d", readDomainsCount)
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error while reading input: %v", err)
+	}
+
+	return nil
+}
+
+/*
+ResolveDomains resolves the domains received on domainChan in background and publishes the records
+on the channel `c`. `threads` lookups are performed concurrently. Function closes the channel once
+domainChan is closed and all the domains are resolved.
+*/
+func ResolveDomains(ctx context.Context, client *dnsengine.Client, threads int,
+	domainChan <-chan common.DomainType, c chan<- common.DomainRecords) {
+	var wg sync.WaitGroup
+
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go resolveWorker(ctx, client, domainChan, c, &wg)
+	}
+
+	go func() {
+		// Close channel to indicate all records resolved
+		wg.Wait()
+
+		log.Infoln("Closing native resolver output channel")
+		close(c)
+	}()
+}
+
+/*
+StartNativeResolver resolves all the domains from inputFile in background using dnsengine and
+publishes the records on the channel `c`. It's a drop-in replacement of massdns and parser.
+`threads` lookups are performed concurrently. Function closes the channel once all the domains
+are resolved or ctx is done. The returned channel receives exactly one value once the input is read:
+the error encountered while reading, nil otherwise.
+*/
+func StartNativeResolver(ctx context.Context, inputFile string, client *dnsengine.Client, threads int,
+	c chan<- common.DomainRecords) (<-chan error, error) {
+	fileObj, err := common.GetInputFile(inputFile)
+	if err != nil {
+		return nil, err
+	}
+
+	errChan := make(chan error, 1)
+
+	domainChan := make(chan common.DomainType)
+
+	ResolveDomains(ctx, client, threads, domainChan, c)
+
+	go func() {
+		if fileObj != os.Stdin {
+			defer fileObj.Close()
+		}
+
+		errChan <- ReadDomains(ctx, fileObj, domainChan)
+	}()
+
+	return errChan, nil
+}
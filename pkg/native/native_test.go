@@ -0,0 +1,57 @@
+package native
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/dnsengine"
+)
+
+func TestStartNativeResolver(t *testing.T) {
+	t.Run("Non existent input file", func(t *testing.T) {
+		c := make(chan common.DomainRecords)
+
+		client := dnsengine.CreateClientInstance(common.DNSServers{"1.1.1.1"}, dnsengine.DefaultConfig())
+
+		_, err := StartNativeResolver(context.Background(), "/xyz/abc", client, 1, c)
+		if err == nil {
+			t.Errorf("StartNativeResolver() error = %v, wantErr %v", err, true)
+		}
+	})
+
+	t.Run("Empty lines are skipped", func(t *testing.T) {
+		inputFile, err := ioutil.TempFile("", "rand0m_tmp_*")
+		if err != nil {
+			t.Errorf("StartNativeResolver(): Encountered error: %v", err)
+			return
+		}
+		defer os.Remove(inputFile.Name())
+
+		_, err = inputFile.Write([]byte("\n  \n.\n"))
+		if err != nil {
+			t.Errorf("StartNativeResolver(): Encountered error: %v", err)
+			return
+		}
+
+		c := make(chan common.DomainRecords)
+
+		client := dnsengine.CreateClientInstance(common.DNSServers{"1.1.1.1"}, dnsengine.DefaultConfig())
+
+		errChan, err := StartNativeResolver(context.Background(), inputFile.Name(), client, 2, c)
+		if err != nil {
+			t.Errorf("StartNativeResolver() error = %v, wantErr %v", err, false)
+			return
+		}
+
+		for data := range c {
+			t.Errorf("StartNativeResolver() got = %v, want no records", data)
+		}
+
+		if err := <-errChan; err != nil {
+			t.Errorf("StartNativeResolver() read error = %v, wantErr %v", err, false)
+		}
+	})
+}
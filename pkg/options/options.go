@@ -5,35 +5,137 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"reflect"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/dnsengine"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/logicengine/wildcardstruct"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/ratelimit"
 
 	"github.com/alexflint/go-arg"
 )
 
+// Number of random names queried against each resolver to check for hijacking
+const numberOfHijackProbes = 2
+
+/*
+Supported backends for resolving input domains
+*/
+const (
+	BackendMassdns = "massdns"
+	BackendNative  = "native"
+	BackendFile    = "file"
+)
+
+/*
+Supported output formats
+*/
+const (
+	FormatText  = "text"
+	FormatJSONL = "jsonl"
+)
+
 /*
 Options to parsed from command arguments
 */
 type Options struct {
-	Domain       string
+	// Domains to filter wildcard subdomains for
+	Domains []string
+	// AutoDomain derives the domain of inputs not under any of Domains from the Public Suffix List
+	AutoDomain   bool
 	Input        string
 	Resolver     common.DNSServers
 	ResolverFile string
-	Threads      int
-	Output       string
-	LogLevel     log.Level
+	// MassdnsResolvers are used by massdns instead of ResolverFile if set e.g. after dropping the
+	// resolvers massdns can't use
+	MassdnsResolvers common.DNSServers
+	// TrustedResolver is used for wildcard probing. Same as Resolver unless provided
+	TrustedResolver common.DNSServers
+	Threads         int
+	Backend         string
+	Concurrency     int
+	QueryConfig     dnsengine.Config
+	ProbeConfig     wildcardstruct.ProbeConfig
+	Output          string
+	Format          string
+	// RemovedOutput is the path to report of removed wildcard domains. Empty if not required
+	RemovedOutput string
+	// Explain is the path to decision trace of each domain. Empty if not required
+	Explain string
+	// ProbeCache is the path to on-disk cache of wildcard probe results. Empty if not required
+	ProbeCache       string
+	ProbeCacheMaxAge time.Duration
+	MaxParents       int
+	LogLevel         log.Level
 }
 
 type internalOptions struct {
-	Domain   string `arg:"-d,required" help:"Domain to filter wildcard subdomains for"`
-	Input    string `arg:"-i,required" help:"Path to input file of list of subdomains. Use - for stdin"`
-	Resolver string `arg:"-r,required" help:"Path to file containing list of resolvers"`
-	Threads  int    `arg:"-t" default:"6" help:"Number of threads to run"`
-	Output   string `arg:"-o,required" help:"Path to output file. Use - for stdout"`
-	Verbose  bool   `arg:"-v" default:"false" help:"Enable debug level logs"`
+	Domain          []string      `arg:"-d,separate" help:"Domain to filter wildcard subdomains for. Repeat to filter for multiple domains, each subdomain is checked for the longest domain it's under"`
+	DomainsFile     string        `arg:"--domains-file" help:"Path to file containing list of domains to filter wildcard subdomains for. Used along with --domain"`
+	AutoDomain      bool          `arg:"--auto-domain" default:"false" help:"Filter subdomains not under any --domain for their registrable domain(e.g. example.co.uk) as per the Public Suffix List"`
+	Input           string        `arg:"-i,required" help:"Path to input file of list of subdomains. Use - for stdin"`
+	Resolver        string        `arg:"-r,required" help:"Path to file containing list of resolvers as host[:port]. Prefix udp://, tcp://, tls:// or https:// to use other transports"`
+	TrustedResolver string        `arg:"--trusted-resolver" help:"Path to file containing list of trusted resolvers used for wildcard probing. Defaults to --resolver"`
+	Threads         int           `arg:"-t" default:"6" help:"Number of threads to run"`
+	Backend         string        `arg:"-b" default:"massdns" help:"Backend used to resolve input domains: massdns, native or file(input is massdns output)"`
+	Concurrency     int           `arg:"-c" default:"100" help:"Number of concurrent lookups for native backend"`
+	Timeout         time.Duration `default:"2s" help:"Timeout for a single DNS query"`
+	Retries         int           `default:"2" help:"Number of retries for a failed DNS query"`
+	Backoff         time.Duration `default:"250ms" help:"Delay before first retry, doubled for each subsequent retry"`
+	MaxParallel     int           `arg:"--max-parallel" default:"10" help:"Maximum number of resolvers queried in parallel for a DNS query. Use 0 for no limit"`
+	UDPSize         uint16        `arg:"--udp-size" default:"1232" help:"UDP buffer size advertised using EDNS0. Use 0 to disable EDNS0"`
+	QPS             int           `arg:"--qps" default:"0" help:"Maximum queries per second across massdns and wildcard probing. For massdns it limits the names fed to it, its retries are not limited. Use 0 for no limit"`
+	ResolverQPS     int           `arg:"--resolver-qps" default:"0" help:"Maximum queries per second to each resolver(not applicable to massdns). Use 0 for no limit"`
+	Probes          int           `arg:"--probes" default:"10" help:"Number of random subdomains probed for each parent domain"`
+	Adaptive        bool          `arg:"--adaptive" default:"false" help:"Stop probing NXDOMAIN parents early and keep probing while new records show up"`
+	MaxProbes       int           `arg:"--max-probes" default:"50" help:"Maximum number of random subdomains probed for each parent domain in adaptive mode"`
+	ProbeCache      string        `arg:"--probe-cache" help:"Path to file caching wildcard probe results across runs. Results are reused only with the same trusted resolvers"`
+	ProbeCacheAge   time.Duration `arg:"--probe-cache-max-age" default:"24h" help:"Maximum age of cached probe results. Use 0 to never expire"`
+	MinTTL          time.Duration `arg:"--min-ttl" default:"1m" help:"Minimum time for which probe results of a parent domain are used before probing again"`
+	MaxTTL          time.Duration `arg:"--max-ttl" default:"1h" help:"Maximum time for which probe results of a parent domain are used before probing again. Results are used for lowest TTL of the records within these bounds. Use 0 to never probe again"`
+	MaxParents      int           `arg:"--max-parents" default:"100000" help:"Maximum number of parent domains whose probe results are kept in memory. Least recently used are evicted beyond it. Also bounds the probe cache, oldest probed are dropped. Use 0 for no limit"`
+	CheckResolvers  bool          `arg:"--check-resolvers" default:"false" help:"Drop resolvers hijacking NXDOMAIN replies before the run"`
+	ProbeDomain     string        `arg:"--probe-domain" default:"invalid" help:"Domain without any record. Random names under it are used to check resolvers"`
+	Output          string        `arg:"-o,required" help:"Path to output file. Use - for stdout"`
+	Format          string        `arg:"--format" default:"text" help:"Output format: text(massdns like) or jsonl"`
+	RemovedOutput   string        `arg:"--removed-output" help:"Path to file for report of removed wildcard domains with the parent and records they matched. Uses --format. Use - for stdout"`
+	Explain         string        `arg:"--explain" help:"Path to file for decision trace of each domain i.e. the parents compared, their wildcard values and the probe errors. Uses --format. Use - for stdout"`
+	Verbose         bool          `arg:"-v" default:"false" help:"Enable debug level logs"`
+}
+
+/*
+parseListOfDomainsFromFile returns the domains listed one per line in the file. Empty lines and
+comments are skipped.
+*/
+func parseListOfDomainsFromFile(filePath string) ([]string, error) {
+	filePtr, err := os.Open(filePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer filePtr.Close()
+
+	returnValue := make([]string, 0)
+
+	scanner := bufio.NewScanner(filePtr)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// Skip empty lines and comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		returnValue = append(returnValue, common.SanitizeDomainName(line))
+	}
+
+	return returnValue, scanner.Err()
 }
 
 func parseListOfResolversFromList(filePath string) (common.DNSServers, error) {
@@ -53,16 +155,134 @@ func parseListOfResolversFromList(filePath string) (common.DNSServers, error) {
 		line := scanner.Text()
 		line = strings.TrimSpace(line)
 
+		// Skip empty lines and comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
 		ip := net.ParseIP(line)
 
 		if ip != nil {
 			returnValue = append(returnValue, ip.String())
+			continue
+		}
+
+		// host:port, hostnames and resolvers with scheme e.g. tls://1.1.1.1:853
+		if _, _, err := dnsengine.ParseResolverAddress(line); err != nil {
+			log.Warningf("Ignoring resolver: %v", err)
+			continue
 		}
+
+		returnValue = append(returnValue, line)
 	}
 
 	return returnValue, nil
 }
 
+/*
+getMassdnsResolvers returns the resolvers in format understood by massdns i.e. IP address with
+optional port. Hostnames are resolved to their IP addresses. massdns only supports plain UDP,
+so other resolvers are skipped.
+*/
+func getMassdnsResolvers(resolvers common.DNSServers) common.DNSServers {
+	returnValue := make(common.DNSServers, 0, len(resolvers))
+
+	for _, resolver := range resolvers {
+		network, address, err := dnsengine.ParseResolverAddress(resolver)
+		if err != nil || network != dnsengine.NetworkUDP {
+			continue
+		}
+
+		host, port, _ := net.SplitHostPort(address)
+		ips := []string{host}
+
+		if net.ParseIP(host) == nil {
+			ips, err = net.LookupHost(host)
+			if err != nil {
+				log.Warningf("Skipping resolver %s for massdns: %v", resolver, err)
+				continue
+			}
+		}
+
+		for _, ip := range ips {
+			if port == "53" {
+				returnValue = append(returnValue, net.ParseIP(ip).String())
+			} else {
+				returnValue = append(returnValue, net.JoinHostPort(ip, port))
+			}
+		}
+	}
+
+	return returnValue
+}
+
+/*
+removeResolvers returns the resolvers which are not present in toRemove
+*/
+func removeResolvers(resolvers common.DNSServers, toRemove common.DNSServers) common.DNSServers {
+	returnValue := make(common.DNSServers, 0, len(resolvers))
+
+	for _, resolver := range resolvers {
+		present := false
+
+		for _, x := range toRemove {
+			if x == resolver {
+				present = true
+				break
+			}
+		}
+
+		if !present {
+			returnValue = append(returnValue, resolver)
+		}
+	}
+
+	return returnValue
+}
+
+/*
+checkOutputPaths returns error if the same file is used for more than one output. Stdout(-) can be
+shared as the writers write whole entries to it.
+*/
+func checkOutputPaths(paths ...string) error {
+	seen := map[string]bool{}
+
+	for _, path := range paths {
+		if path == "" || path == "-" {
+			continue
+		}
+
+		if seen[path] {
+			return fmt.Errorf("same file used for more than one output: %s", path)
+		}
+
+		seen[path] = true
+	}
+
+	return nil
+}
+
+/*
+dropHijackingResolvers checks the resolvers for hijacking NXDOMAIN replies by querying random names
+under probeDomain and returns the remaining resolvers
+*/
+func dropHijackingResolvers(resolvers common.DNSServers, probeDomain string,
+	config dnsengine.Config) common.DNSServers {
+	probeNames := make([]string, 0, numberOfHijackProbes)
+
+	for i := 0; i < numberOfHijackProbes; i++ {
+		probeNames = append(probeNames, wildcardstruct.GetRandomSubdomain(common.SanitizeDomainName(probeDomain)))
+	}
+
+	hijackingResolvers := dnsengine.FindHijackingResolvers(resolvers, probeNames, config)
+
+	for _, resolver := range hijackingResolvers {
+		log.Warningf("Dropping resolver %s as it hijacks NXDOMAIN replies", resolver)
+	}
+
+	return removeResolvers(resolvers, hijackingResolvers)
+}
+
 /*
 ParseOptionsArguments parses options from argument and return an instance of Options struct and error.
 */
@@ -70,6 +290,25 @@ func ParseOptionsArguments() (Options, error) {
 	var parsedOptions internalOptions
 	arg.MustParse(&parsedOptions)
 
+	domains := make([]string, 0, len(parsedOptions.Domain))
+	for _, domain := range parsedOptions.Domain {
+		domains = append(domains, common.SanitizeDomainName(domain))
+	}
+
+	if parsedOptions.DomainsFile != "" {
+		fileDomains, err := parseListOfDomainsFromFile(parsedOptions.DomainsFile)
+		if err != nil {
+			return Options{}, err
+		}
+
+		domains = append(domains, fileDomains...)
+	}
+
+	if len(domains) == 0 && !parsedOptions.AutoDomain {
+		return Options{}, fmt.Errorf(
+			"at least one domain is required using --domain, --domains-file or --auto-domain")
+	}
+
 	resolvers, err := parseListOfResolversFromList(parsedOptions.Resolver)
 	if err != nil {
 		return Options{}, err
@@ -79,19 +318,108 @@ func ParseOptionsArguments() (Options, error) {
 		return Options{}, fmt.Errorf("non valid resolver(DNS Server) found")
 	}
 
+	queryConfig := dnsengine.Config{
+		Timeout:     parsedOptions.Timeout,
+		Retries:     parsedOptions.Retries,
+		Backoff:     parsedOptions.Backoff,
+		MaxParallel: parsedOptions.MaxParallel,
+		UDPSize:     parsedOptions.UDPSize,
+		// Shared by all the clients and massdns
+		Limiter:          ratelimit.CreateLimiterInstance(parsedOptions.QPS),
+		ResolverLimiters: ratelimit.CreateLimiterGroupInstance(parsedOptions.ResolverQPS),
+	}
+
+	switch parsedOptions.Format {
+	case FormatText, FormatJSONL:
+	default:
+		return Options{}, fmt.Errorf("unknown output format: %s", parsedOptions.Format)
+	}
+
+	err = checkOutputPaths(parsedOptions.Output, parsedOptions.RemovedOutput, parsedOptions.Explain)
+	if err != nil {
+		return Options{}, err
+	}
+
+	if parsedOptions.ProbeCacheAge < 0 {
+		return Options{}, fmt.Errorf("probe cache max age can't be negative")
+	}
+
+	switch parsedOptions.Backend {
+	case BackendMassdns, BackendNative, BackendFile:
+	default:
+		return Options{}, fmt.Errorf("unknown backend: %s", parsedOptions.Backend)
+	}
+
+	parsedResolvers := resolvers
+
+	if parsedOptions.CheckResolvers {
+		resolvers = dropHijackingResolvers(resolvers, parsedOptions.ProbeDomain, queryConfig)
+
+		if len(resolvers) == 0 {
+			return Options{}, fmt.Errorf("all the resolvers hijack NXDOMAIN replies")
+		}
+	}
+
+	var massdnsResolvers common.DNSServers
+
+	if parsedOptions.Backend == BackendMassdns {
+		massdnsResolvers = getMassdnsResolvers(resolvers)
+
+		if len(massdnsResolvers) == 0 {
+			return Options{}, fmt.Errorf("no resolver usable by massdns found(only plain UDP is supported)")
+		}
+
+		// Resolver file can be used as is
+		if reflect.DeepEqual(massdnsResolvers, parsedResolvers) {
+			massdnsResolvers = nil
+		}
+	}
+
+	trustedResolvers := resolvers
+
+	if parsedOptions.TrustedResolver != "" {
+		trustedResolvers, err = parseListOfResolversFromList(parsedOptions.TrustedResolver)
+		if err != nil {
+			return Options{}, err
+		}
+
+		if len(trustedResolvers) == 0 {
+			return Options{}, fmt.Errorf("non valid trusted resolver(DNS Server) found")
+		}
+	}
+
 	logLevel := log.InfoLevel
 	if parsedOptions.Verbose {
 		logLevel = log.DebugLevel
 	}
 
 	returnOptions := Options{
-		Domain:       common.SanitizeDomainName(parsedOptions.Domain),
-		Input:        parsedOptions.Input,
-		Resolver:     resolvers,
-		ResolverFile: parsedOptions.Resolver,
-		Threads:      parsedOptions.Threads,
-		Output:       parsedOptions.Output,
-		LogLevel:     logLevel,
+		Domains:          domains,
+		AutoDomain:       parsedOptions.AutoDomain,
+		Input:            parsedOptions.Input,
+		Resolver:         resolvers,
+		ResolverFile:     parsedOptions.Resolver,
+		MassdnsResolvers: massdnsResolvers,
+		TrustedResolver:  trustedResolvers,
+		Threads:          parsedOptions.Threads,
+		Backend:          parsedOptions.Backend,
+		Concurrency:      parsedOptions.Concurrency,
+		QueryConfig:      queryConfig,
+		ProbeConfig: wildcardstruct.ProbeConfig{
+			Count:    parsedOptions.Probes,
+			Adaptive: parsedOptions.Adaptive,
+			MaxCount: parsedOptions.MaxProbes,
+			MinTTL:   parsedOptions.MinTTL,
+			MaxTTL:   parsedOptions.MaxTTL,
+		},
+		Output:           parsedOptions.Output,
+		Format:           parsedOptions.Format,
+		RemovedOutput:    parsedOptions.RemovedOutput,
+		Explain:          parsedOptions.Explain,
+		ProbeCache:       parsedOptions.ProbeCache,
+		ProbeCacheMaxAge: parsedOptions.ProbeCacheAge,
+		MaxParents:       parsedOptions.MaxParents,
+		LogLevel:         logLevel,
 	}
 
 	return returnOptions, nil
@@ -37,6 +37,22 @@ func Test_parseListOfResolversFromList(t *testing.T) {
 			want:    common.DNSServers{"1.1.1.1", "8.8.8.8"},
 			wantErr: false,
 		},
+		{
+			name: "Verify resolvers with port and hostnames",
+			args: args{
+				fileData: "1.2.3.4:5353\n[2001:db8::1]:53\n2001:db8::2\nresolver.example:5353\n\n1.2.3.4:abc",
+			},
+			want:    common.DNSServers{"1.2.3.4:5353", "[2001:db8::1]:53", "2001:db8::2", "resolver.example:5353"},
+			wantErr: false,
+		},
+		{
+			name: "Verify resolvers with scheme",
+			args: args{
+				fileData: "1.1.1.1\ntls://1.1.1.1:853\nhttps://dns.example/dns-query\nquic://1.1.1.1",
+			},
+			want:    common.DNSServers{"1.1.1.1", "tls://1.1.1.1:853", "https://dns.example/dns-query"},
+			wantErr: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -59,3 +75,87 @@ func Test_parseListOfResolversFromList(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseListOfDomainsFromFile(t *testing.T) {
+	file, err := writeToTempFile("example.com\n\n# comment\n Dev.Example.COM. \n")
+	defer os.Remove(file.Name())
+	if err != nil {
+		t.Errorf("parseListOfDomainsFromFile(): Encountered error: %v", err)
+		return
+	}
+
+	got, err := parseListOfDomainsFromFile(file.Name())
+	if err != nil {
+		t.Errorf("parseListOfDomainsFromFile() error = %v, wantErr %v", err, false)
+		return
+	}
+
+	want := []string{"example.com.", "dev.example.com."}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseListOfDomainsFromFile() got = %v, want %v", got, want)
+	}
+}
+
+func Test_removeResolvers(t *testing.T) {
+	got := removeResolvers(common.DNSServers{"1.1.1.1", "8.8.8.8", "9.9.9.9"}, common.DNSServers{"8.8.8.8"})
+	want := common.DNSServers{"1.1.1.1", "9.9.9.9"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("removeResolvers() = %v, want %v", got, want)
+	}
+}
+
+func Test_getMassdnsResolvers(t *testing.T) {
+	resolvers := common.DNSServers{
+		"1.1.1.1",
+		"udp://8.8.8.8",
+		"udp://9.9.9.9:5353",
+		"1.2.3.4:5353",
+		"[2001:db8::1]:53",
+		"[2001:db8::2]:5353",
+		"tcp://1.1.1.1",
+		"tls://1.1.1.1",
+		"https://dns.example/dns-query",
+	}
+
+	got := getMassdnsResolvers(resolvers)
+	want := common.DNSServers{"1.1.1.1", "8.8.8.8", "9.9.9.9:5353", "1.2.3.4:5353", "2001:db8::1",
+		"[2001:db8::2]:5353"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getMassdnsResolvers() = %v, want %v", got, want)
+	}
+}
+
+func Test_checkOutputPaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		paths   []string
+		wantErr bool
+	}{
+		{
+			name:    "Different files",
+			paths:   []string{"out.txt", "removed.txt", ""},
+			wantErr: false,
+		},
+		{
+			name:    "Shared stdout",
+			paths:   []string{"-", "-", "-"},
+			wantErr: false,
+		},
+		{
+			name:    "Shared file",
+			paths:   []string{"out.txt", "-", "out.txt"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkOutputPaths(tt.paths...); (err != nil) != tt.wantErr {
+				t.Errorf("checkOutputPaths() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,71 +1,358 @@
 package output
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/filter"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/options"
 )
 
-func getOutputFile(path string) (*os.File, error) {
-	if path == "-" {
-		return os.Stdout, nil
+/*
+flushWriter is a buffered writer
+*/
+type flushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+/*
+syncWriter is a buffered writer safe for concurrent use. Each Write is written as a whole, so the
+entries of concurrent writers aren't split.
+*/
+type syncWriter struct {
+	mutex  sync.Mutex
+	writer *bufio.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.writer.Write(p)
+}
+
+func (s *syncWriter) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.writer.Flush()
+}
+
+// stdout is shared by all the writers writing to stdout i.e. path -. It's never closed
+var stdout flushWriter = &syncWriter{writer: bufio.NewWriter(os.Stdout)}
+
+/*
+writeADomainOutputToFile write output for a single domain to output file in a single write
+*/
+func writeADomainOutputToFile(file io.Writer, data string) error {
+	_, err := file.Write([]byte(data + "\n"))
+
+	return err
+}
+
+/*
+formatText returns the massdns like output for a domain. In case of CNAME only the first record is used
+*/
+func formatText(result filter.Result) (string, error) {
+	records := result.Records.Records
+	recordType := records[0].Type
+
+	// Write all the addresses. In case of CNAME only the first record is written
+	if recordType == common.TypeA || recordType == common.TypeAAAA {
+		return records.String(), nil
 	}
 
-	return os.Create(path)
+	return records[0].String(), nil
+}
+
+/*
+jsonlEntry is the object written for each domain in jsonl format
+*/
+type jsonlEntry struct {
+	Domain         string              `json:"domain"`
+	Records        common.DNSRecordSet `json:"records"`
+	IPs            []string            `json:"ips"`
+	CheckedParents []string            `json:"checked_parents"`
+	MatchedParent  string              `json:"matched_parent,omitempty"`
+	MatchedRecords common.DNSRecordSet `json:"matched_records,omitempty"`
 }
 
 /*
-writeADomainOutputToFile write output for a single domain to output file
+getIPs returns the unique A and AAAA values from the records in order of appearance
 */
-func writeADomainOutputToFile(file *os.File, data string) error {
-	_, err := file.Write([]byte(data))
+func getIPs(records common.DNSRecordSet) []string {
+	ips := make([]string, 0)
+	seen := map[string]bool{}
+
+	for _, record := range records {
+		if record.Type != common.TypeA && record.Type != common.TypeAAAA {
+			continue
+		}
+
+		if !seen[record.Value] {
+			seen[record.Value] = true
+			ips = append(ips, record.Value)
+		}
+	}
+
+	return ips
+}
+
+/*
+formatJSONL returns a single line JSON object for a domain with the full record chain
+*/
+func formatJSONL(result filter.Result) (string, error) {
+	entry := jsonlEntry{
+		Domain:         result.Records.DomainName,
+		Records:        result.Records.Records,
+		IPs:            getIPs(result.Records.Records),
+		CheckedParents: result.CheckedParents,
+		MatchedParent:  result.MatchedParent,
+		MatchedRecords: result.MatchedRecords,
+	}
+
+	if entry.CheckedParents == nil {
+		entry.CheckedParents = make([]string, 0)
+	}
+
+	data, err := json.Marshal(entry)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	_, err = file.Write([]byte("\n"))
+	return string(data), nil
+}
 
-	return err
+/*
+formatRemovedText returns a line for each wildcard record a removed domain matched. Each line is
+the domain, the matched parent and the wildcard record e.g.
+abc.example.com. example.com. *.example.com. A 1.2.3.4
+*/
+func formatRemovedText(result filter.Result) (string, error) {
+	lines := make([]string, 0, len(result.MatchedRecords))
+
+	for _, record := range result.MatchedRecords {
+		lines = append(lines, fmt.Sprintf("%s %s %s", result.Records.DomainName, result.MatchedParent, record))
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+/*
+getDecision returns the decision taken for a domain as kept, removed or failed
+*/
+func getDecision(result filter.Result) string {
+	switch {
+	case result.Err != nil:
+		return "failed"
+	case result.IsWildcard:
+		return "removed"
+	default:
+		return "kept"
+	}
+}
+
+/*
+formatExplainText returns the decision for a domain followed by an indented line for each parent
+compared e.g.
+abc.example.com. removed
+
+	example.com. parent=[1.2.3.4] domain=[1.2.3.4] subset=true
+*/
+func formatExplainText(result filter.Result) (string, error) {
+	line := fmt.Sprintf("%s %s", result.Records.DomainName, getDecision(result))
+	if result.Err != nil {
+		line += fmt.Sprintf(" error=%q", result.Err.Error())
+	}
+
+	lines := []string{line}
+
+	for _, step := range result.Trace {
+		line := fmt.Sprintf("  %s parent=[%s] domain=[%s] subset=%t", step.Parent,
+			strings.Join(step.ParentValues, " "), strings.Join(step.DomainValues, " "), step.IsSubset)
+
+		if step.ProbeErr != nil {
+			line += fmt.Sprintf(" probe_error=%q", step.ProbeErr.Error())
+		}
+
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n"), nil
 }
 
 /*
-StartWritingOutput write the DNS records from the channel to output file. This is a blocking method,
-it waits until there are no more records to write
+explainStep is the object written for each parent compared in jsonl format
 */
-func StartWritingOutput(outputFilePath string, c <-chan common.DomainRecords) error {
-	outputFile, err := getOutputFile(outputFilePath)
+type explainStep struct {
+	Parent       string   `json:"parent"`
+	ParentValues []string `json:"parent_values"`
+	DomainValues []string `json:"domain_values"`
+	IsSubset     bool     `json:"subset"`
+	ProbeError   string   `json:"probe_error,omitempty"`
+}
 
+/*
+explainEntry is the object written for each domain in jsonl format
+*/
+type explainEntry struct {
+	Domain   string        `json:"domain"`
+	Decision string        `json:"decision"`
+	Error    string        `json:"error,omitempty"`
+	Trace    []explainStep `json:"trace"`
+}
+
+/*
+formatExplainJSONL returns a single line JSON object with the decision and trace for a domain
+*/
+func formatExplainJSONL(result filter.Result) (string, error) {
+	entry := explainEntry{
+		Domain:   result.Records.DomainName,
+		Decision: getDecision(result),
+		Trace:    make([]explainStep, 0, len(result.Trace)),
+	}
+
+	if result.Err != nil {
+		entry.Error = result.Err.Error()
+	}
+
+	for _, step := range result.Trace {
+		traceStep := explainStep{
+			Parent:       step.Parent,
+			ParentValues: step.ParentValues,
+			DomainValues: step.DomainValues,
+			IsSubset:     step.IsSubset,
+		}
+
+		if step.ProbeErr != nil {
+			traceStep.ProbeError = step.ProbeErr.Error()
+		}
+
+		entry.Trace = append(entry.Trace, traceStep)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+/*
+formatter converts the result for a single domain to the data written to output
+*/
+type formatter func(result filter.Result) (string, error)
+
+/*
+getFormatter returns text or jsonl formatter as per format
+*/
+func getFormatter(format string, text formatter, jsonl formatter) (formatter, error) {
+	switch format {
+	case options.FormatText:
+		return text, nil
+	case options.FormatJSONL:
+		return jsonl, nil
+	}
+
+	return nil, fmt.Errorf("unknown output format: %s", format)
+}
+
+/*
+StartWritingOutput write the results from the channel to output file as per format. This is a blocking
+method, it waits until there are no more results to write. Output is buffered and flushed before returning.
+*/
+func StartWritingOutput(outputFilePath string, format string, c <-chan filter.Result) error {
+	formatResult, err := getFormatter(format, formatText, formatJSONL)
+	if err != nil {
+		return err
+	}
+
+	return writeResults(outputFilePath, formatResult, c)
+}
+
+/*
+StartWritingRemovedOutput is same as StartWritingOutput but writes the report of removed wildcard
+domains. Each domain is written with the parent it matched and the parent's wildcard records.
+*/
+func StartWritingRemovedOutput(outputFilePath string, format string, c <-chan filter.Result) error {
+	// Matched parent and records are set only for removed domains
+	formatResult, err := getFormatter(format, formatRemovedText, formatJSONL)
+	if err != nil {
+		return err
+	}
+
+	return writeResults(outputFilePath, formatResult, c)
+}
+
+/*
+StartWritingExplainOutput is same as StartWritingOutput but writes the decision trace of each domain.
+Domains which couldn't be checked are written with the error.
+*/
+func StartWritingExplainOutput(outputFilePath string, format string, c <-chan filter.Result) error {
+	formatResult, err := getFormatter(format, formatExplainText, formatExplainJSONL)
 	if err != nil {
 		return err
 	}
 
-	defer outputFile.Close()
+	return writeResults(outputFilePath, formatResult, c)
+}
+
+/*
+writeResults write the results from the channel to output file using formatResult. Path - writes
+to stdout, which can be shared by concurrent writers.
+*/
+func writeResults(outputFilePath string, formatResult formatter, c <-chan filter.Result) (err error) {
+	writer := stdout
+
+	if outputFilePath != "-" {
+		outputFile, err := os.Create(outputFilePath)
+		if err != nil {
+			return err
+		}
+
+		defer outputFile.Close()
+
+		writer = bufio.NewWriter(outputFile)
+	}
+
+	defer func() {
+		flushErr := writer.Flush()
+		if err == nil {
+			err = flushErr
+		}
+	}()
 
 	for {
-		domainRecord, more := <-c
+		result, more := <-c
 
 		if !more {
 			break
 		}
 
-		if domainRecord.Records[0].Type == "A" {
-			err := writeADomainOutputToFile(outputFile, domainRecord.Records.String())
-			if err != nil {
-				return err
-			}
-		} else {
-			err := writeADomainOutputToFile(outputFile, domainRecord.Records[0].String())
-			if err != nil {
-				return err
-			}
+		data, err := formatResult(result)
+		if err != nil {
+			return err
+		}
+
+		err = writeADomainOutputToFile(writer, data)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
 /*
-CreateChannel return a new channel for passing DomainRecords
+CreateChannel return a new channel for passing results to be written
 */
-func CreateChannel() chan common.DomainRecords {
-	return make(chan common.DomainRecords)
+func CreateChannel() chan filter.Result {
+	return make(chan filter.Result)
 }
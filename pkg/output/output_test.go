@@ -0,0 +1,282 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/filter"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/logicengine"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/options"
+)
+
+func TestStartWritingOutput(t *testing.T) {
+	result := filter.Result{
+		Records: common.DomainRecords{
+			DomainName: "www.example.com.",
+			Records: common.DNSRecordSet{
+				{Name: "www.example.com.", Type: common.TypeCNAME, Value: "example.com."},
+				{Name: "example.com.", Type: common.TypeA, Value: "1.2.3.4"},
+				{Name: "example.com.", Type: common.TypeA, Value: "1.2.3.4"},
+			},
+		},
+		Verdict: logicengine.Verdict{
+			CheckedParents: []string{"example.com."},
+		},
+	}
+
+	removedResult := filter.Result{
+		Records: common.DomainRecords{
+			DomainName: "abc.example.com.",
+			Records: common.DNSRecordSet{
+				{Name: "abc.example.com.", Type: common.TypeA, Value: "1.2.3.4"},
+			},
+		},
+		Verdict: logicengine.Verdict{
+			IsWildcard:     true,
+			CheckedParents: []string{"example.com."},
+			MatchedParent:  "example.com.",
+			MatchedRecords: common.DNSRecordSet{
+				{Name: "*.example.com.", Type: common.TypeA, Value: "1.2.3.4"},
+				{Name: "*.example.com.", Type: common.TypeA, Value: "5.6.7.8"},
+			},
+		},
+	}
+
+	explainResult := filter.Result{
+		Records: removedResult.Records,
+		Verdict: logicengine.Verdict{
+			IsWildcard:     true,
+			CheckedParents: []string{"example.com.", "sub.example.com."},
+			Trace: []logicengine.TraceStep{
+				{
+					Parent:       "example.com.",
+					ParentValues: []string{},
+					DomainValues: []string{"1.2.3.4"},
+					IsSubset:     false,
+					ProbeErr:     errors.New("timeout"),
+				},
+				{
+					Parent:       "sub.example.com.",
+					ParentValues: []string{"1.2.3.4", "5.6.7.8"},
+					DomainValues: []string{"1.2.3.4"},
+					IsSubset:     true,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		format  string
+		write   func(string, string, <-chan filter.Result) error
+		result  filter.Result
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "text",
+			format:  options.FormatText,
+			result:  result,
+			want:    "www.example.com. CNAME example.com.\n",
+			wantErr: false,
+		},
+		{
+			name:   "jsonl",
+			format: options.FormatJSONL,
+			result: result,
+			want: `{"domain":"www.example.com.","records":[` +
+				`{"name":"www.example.com.","type":"CNAME","value":"example.com."},` +
+				`{"name":"example.com.","type":"A","value":"1.2.3.4"},` +
+				`{"name":"example.com.","type":"A","value":"1.2.3.4"}],` +
+				`"ips":["1.2.3.4"],"checked_parents":["example.com."]}` + "\n",
+			wantErr: false,
+		},
+		{
+			name:   "jsonl without checked parents",
+			format: options.FormatJSONL,
+			result: filter.Result{
+				Records: common.DomainRecords{
+					DomainName: "example.com.",
+					Records: common.DNSRecordSet{
+						{Name: "example.com.", Type: common.TypeCNAME, Value: "example.net."},
+					},
+				},
+			},
+			want: `{"domain":"example.com.","records":[` +
+				`{"name":"example.com.","type":"CNAME","value":"example.net."}],` +
+				`"ips":[],"checked_parents":[]}` + "\n",
+			wantErr: false,
+		},
+		{
+			name:   "removed text",
+			format: options.FormatText,
+			write:  StartWritingRemovedOutput,
+			result: removedResult,
+			want: "abc.example.com. example.com. *.example.com. A 1.2.3.4\n" +
+				"abc.example.com. example.com. *.example.com. A 5.6.7.8\n",
+			wantErr: false,
+		},
+		{
+			name:   "removed jsonl",
+			format: options.FormatJSONL,
+			write:  StartWritingRemovedOutput,
+			result: removedResult,
+			want: `{"domain":"abc.example.com.","records":[` +
+				`{"name":"abc.example.com.","type":"A","value":"1.2.3.4"}],` +
+				`"ips":["1.2.3.4"],"checked_parents":["example.com."],"matched_parent":"example.com.",` +
+				`"matched_records":[{"name":"*.example.com.","type":"A","value":"1.2.3.4"},` +
+				`{"name":"*.example.com.","type":"A","value":"5.6.7.8"}]}` + "\n",
+			wantErr: false,
+		},
+		{
+			name:   "explain text",
+			format: options.FormatText,
+			write:  StartWritingExplainOutput,
+			result: explainResult,
+			want: "abc.example.com. removed\n" +
+				"  example.com. parent=[] domain=[1.2.3.4] subset=false probe_error=\"timeout\"\n" +
+				"  sub.example.com. parent=[1.2.3.4 5.6.7.8] domain=[1.2.3.4] subset=true\n",
+			wantErr: false,
+		},
+		{
+			name:   "explain jsonl",
+			format: options.FormatJSONL,
+			write:  StartWritingExplainOutput,
+			result: explainResult,
+			want: `{"domain":"abc.example.com.","decision":"removed","trace":[` +
+				`{"parent":"example.com.","parent_values":[],"domain_values":["1.2.3.4"],"subset":false,"probe_error":"timeout"},` +
+				`{"parent":"sub.example.com.","parent_values":["1.2.3.4","5.6.7.8"],"domain_values":["1.2.3.4"],"subset":true}]}` + "\n",
+			wantErr: false,
+		},
+		{
+			name:   "explain failed",
+			format: options.FormatText,
+			write:  StartWritingExplainOutput,
+			result: filter.Result{
+				Records: removedResult.Records,
+				Err:     errors.New("out-of-scope"),
+			},
+			want:    "abc.example.com. failed error=\"out-of-scope\"\n",
+			wantErr: false,
+		},
+		{
+			name:    "unknown",
+			format:  "xml",
+			result:  result,
+			want:    "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputFile, err := ioutil.TempFile("", "rand0m_tmp_*")
+			if err != nil {
+				t.Errorf("StartWritingOutput(): Encountered error: %v", err)
+				return
+			}
+			defer os.Remove(outputFile.Name())
+
+			c := make(chan filter.Result, 1)
+			c <- tt.result
+			close(c)
+
+			write := tt.write
+			if write == nil {
+				write = StartWritingOutput
+			}
+
+			err = write(outputFile.Name(), tt.format, c)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("StartWritingOutput() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			got, err := ioutil.ReadFile(outputFile.Name())
+			if err != nil {
+				t.Errorf("StartWritingOutput(): Encountered error: %v", err)
+				return
+			}
+
+			if string(got) != tt.want {
+				t.Errorf("StartWritingOutput() got = %v, want %v", string(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestStartWritingOutput_sharedStdout(t *testing.T) {
+	buffer := new(bytes.Buffer)
+
+	defaultStdout := stdout
+	stdout = &syncWriter{writer: bufio.NewWriter(buffer)}
+	defer func() { stdout = defaultStdout }()
+
+	// Long enough to span multiple flushes of the buffer
+	domainName := strings.Repeat("a", 60) + ".example.com."
+	result := filter.Result{
+		Records: common.DomainRecords{
+			DomainName: domainName,
+			Records:    common.DNSRecordSet{{Name: domainName, Type: common.TypeA, Value: "1.2.3.4"}},
+		},
+	}
+
+	writers := []func(string, string, <-chan filter.Result) error{
+		StartWritingOutput,
+		StartWritingExplainOutput,
+		StartWritingOutput,
+	}
+	count := 1000
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(writers))
+
+	for i, write := range writers {
+		wg.Add(1)
+
+		go func(i int, write func(string, string, <-chan filter.Result) error) {
+			defer wg.Done()
+
+			c := make(chan filter.Result)
+			go func() {
+				for j := 0; j < count; j++ {
+					c <- result
+				}
+				close(c)
+			}()
+
+			errs[i] = write("-", options.FormatText, c)
+		}(i, write)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("StartWritingOutput() error = %v, wantErr %v", err, false)
+			return
+		}
+	}
+
+	want := map[string]int{
+		domainName + " A 1.2.3.4": 2 * count,
+		domainName + " kept":      count,
+	}
+
+	got := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSuffix(buffer.String(), "\n"), "\n") {
+		got[line]++
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("StartWritingOutput() got %d distinct lines, want %v", len(got), want)
+	}
+}
@@ -2,7 +2,10 @@ package parser
 
 import (
 	"bufio"
+	"context"
+	"fmt"
 	"io"
+	"strconv"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -10,25 +13,163 @@ import (
 	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
 )
 
+// Number of blocks for which a domain is held to merge the blocks of other record types into it. Same
+// as massdns's default hashmap size i.e. the number of lookups in flight
+const mergeWindow = 10000
+
+/*
+parseRecord parses a single record. Both 'name type value' and 'name TTL class type value' formats are
+supported. ok is false if the line is malformed.
+*/
+func parseRecord(parts []string) (record common.DNSRecord, ok bool) {
+	if len(parts) >= 5 {
+		if ttl, err := strconv.ParseUint(parts[1], 10, 32); err == nil {
+			record.TTL = uint32(ttl)
+			// Skip TTL and class
+			parts = append([]string{parts[0]}, parts[3:]...)
+		}
+	}
+
+	if len(parts) < 3 {
+		return record, false
+	}
+
+	record.Name = common.SanitizeDomainName(parts[0])
+	record.Type = parts[1]
+	record.Value = parts[2]
+
+	// sanitize the value if it's a CNAME
+	if record.Type == common.TypeCNAME {
+		record.Value = common.SanitizeDomainName(record.Value)
+	}
+
+	return record, true
+}
+
+/*
+mergeRecords appends records of `b` to `a` skipping the ones already present in `a`, ignoring the TTL.
+Blocks for A and AAAA queries share the CNAME chain, which should be present only once.
+*/
+func mergeRecords(a common.DNSRecordSet, b common.DNSRecordSet) common.DNSRecordSet {
+	for _, newRecord := range b {
+		present := false
+
+		for _, record := range a {
+			if record.Name == newRecord.Name && record.Type == newRecord.Type && record.Value == newRecord.Value {
+				present = true
+				break
+			}
+		}
+
+		if !present {
+			a = append(a, newRecord)
+		}
+	}
+
+	return a
+}
+
+/*
+pendingDomains holds the parsed domains until the blocks of other record types are likely merged into
+them. massdns writes a separate block for each record type of a domain, in the order replies arrive.
+*/
+type pendingDomains struct {
+	domains map[string]*common.DomainRecords
+	order   []string
+}
+
+/*
+add merges the block into the pending domain of same name, or adds it as a new pending domain
+*/
+func (p *pendingDomains) add(block *common.DomainRecords) {
+	if pending, ok := p.domains[block.DomainName]; ok {
+		pending.Records = mergeRecords(pending.Records, block.Records)
+		return
+	}
+
+	p.domains[block.DomainName] = block
+	p.order = append(p.order, block.DomainName)
+}
+
+/*
+pop removes and returns the oldest pending domain
+*/
+func (p *pendingDomains) pop() common.DomainRecords {
+	domainName := p.order[0]
+	p.order = p.order[1:]
+
+	domain := p.domains[domainName]
+	delete(p.domains, domainName)
+
+	return *domain
+}
+
 /*
-ParseAndPublishDNSRecords parsed the records from the io.PipeReader and published the records on
-the channel `c`. Function closes the channel once there is no more input(pipe closed)
+ParseAndPublishDNSRecords parsed the records from the reader(massdns output) and published the records on
+the channel `c`. Function closes the channel once there is no more input(pipe closed) or ctx is done.
+Blocks of the same domain are merged so each domain is published once, provided the blocks are at most
+mergeWindow blocks apart. Malformed lines are skipped. The returned channel receives exactly one value
+before `c` is closed: the error encountered while reading or about the skipped lines, nil otherwise.
 */
-func ParseAndPublishDNSRecords(reader *io.PipeReader, c chan<- common.DomainRecords) {
+func ParseAndPublishDNSRecords(ctx context.Context, reader io.ReadCloser, c chan<- common.DomainRecords) <-chan error {
+	errChan := make(chan error, 1)
 	scanner := bufio.NewScanner(reader)
 	var currentDomainRecords *common.DomainRecords
 	currentDomainRecords = nil
 
+	parsingDone := make(chan struct{})
+
+	// Close the reader to unblock the scanner if ctx is done while waiting for input
+	go func() {
+		select {
+		case <-ctx.Done():
+			reader.Close()
+		case <-parsingDone:
+		}
+	}()
+
 	// Start a new goroutine to parse data from massdns output
 	// Pass the data into new channel
 	go func() {
 		// Close channel to indicate all records parsed
 		defer close(c)
 
-		// Close pipeReader to avoid any potential issues
+		var parseErr error
+		defer func() {
+			errChan <- parseErr
+		}()
+
+		// Close reader to avoid any potential issues
 		defer reader.Close()
+		defer close(parsingDone)
 
 		parsedDomainsCount := 0
+		malformedLinesCount := 0
+
+		publish := func(x common.DomainRecords) bool {
+			select {
+			case <-ctx.Done():
+				log.Infoln("Parsing cancelled")
+				return false
+			case c <- x:
+				return true
+			}
+		}
+
+		pending := pendingDomains{domains: map[string]*common.DomainRecords{}}
+
+		publishOldest := func() bool {
+			if !publish(pending.pop()) {
+				return false
+			}
+			parsedDomainsCount++
+
+			if parsedDomainsCount%10000 == 0 {
+				log.Infof("Number of domains parsed until now: %d", parsedDomainsCount)
+			}
+
+			return true
+		}
 
 		for scanner.Scan() {
 			line := scanner.Text()
@@ -36,54 +177,56 @@ func ParseAndPublishDNSRecords(reader *io.PipeReader, c chan<- common.DomainReco
 			// Reset objects
 			if line == "" {
 				if currentDomainRecords != nil {
-					c <- *currentDomainRecords
+					pending.add(currentDomainRecords)
 					currentDomainRecords = nil
-					parsedDomainsCount++
 
-					if parsedDomainsCount%10000 == 0 {
-						log.Infof("Number of domains parsed until now: %d", parsedDomainsCount)
+					if len(pending.order) > mergeWindow && !publishOldest() {
+						return
 					}
 				}
 				continue
 			}
 
-			parts := strings.Split(line, " ")
+			newRecord, ok := parseRecord(strings.Split(line, " "))
+
+			if !ok {
+				log.Warningf("Skipping malformed line: %s", line)
+				malformedLinesCount++
+				continue
+			}
 
 			// Create new DNS Record and set the corresponding Domain
 			if currentDomainRecords == nil {
 				currentDomainRecords = new(common.DomainRecords)
-				currentDomainRecords.DomainName = common.SanitizeDomainName(parts[0])
-			}
-
-			var newRecord common.DNSRecord
-
-			if parts[1] == "CNAME" {
-				newRecord = common.DNSRecord{
-					Name: common.SanitizeDomainName(parts[0]),
-					Type: parts[1],
-					// sanitize the value if it's a CNAME
-					Value: common.SanitizeDomainName(parts[2]),
-				}
-			} else {
-				newRecord = common.DNSRecord{
-					Name:  common.SanitizeDomainName(parts[0]),
-					Type:  parts[1],
-					Value: parts[2],
-				}
+				currentDomainRecords.DomainName = newRecord.Name
 			}
 
 			currentDomainRecords.Records = append(currentDomainRecords.Records, newRecord)
 		}
 
 		if currentDomainRecords != nil {
-			c <- *currentDomainRecords
+			pending.add(currentDomainRecords)
 			currentDomainRecords = nil
-			parsedDomainsCount++
+		}
+
+		for len(pending.order) > 0 {
+			if !publishOldest() {
+				return
+			}
+		}
+
+		// Error caused by cancellation isn't a failure
+		if err := scanner.Err(); err != nil && ctx.Err() == nil {
+			parseErr = fmt.Errorf("error while reading records: %v", err)
+		} else if malformedLinesCount > 0 {
+			parseErr = fmt.Errorf("skipped %d malformed lines", malformedLinesCount)
 		}
 
 		log.Infof("Number of domains parsed from massdns output: %d", parsedDomainsCount)
 		log.Infoln("Closing parser output channel")
 	}()
+
+	return errChan
 }
 
 /*
@@ -1,8 +1,11 @@
 package parser
 
 import (
+	"context"
 	"io"
+	"io/ioutil"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -32,7 +35,7 @@ func TestParseAndPublishDNSRecords(t *testing.T) {
 	}
 
 	t.Run("Parser Test", func(t *testing.T) {
-		ParseAndPublishDNSRecords(reader, c)
+		ParseAndPublishDNSRecords(context.Background(), reader, c)
 
 		go func() {
 			// Simulate some delay in reading(as in processing overhead)
@@ -54,3 +57,130 @@ func TestParseAndPublishDNSRecords(t *testing.T) {
 		}
 	})
 }
+
+func TestParseAndPublishDNSRecords_cancelled(t *testing.T) {
+	t.Parallel()
+
+	// Nothing is ever written to the pipe
+	reader, _ := io.Pipe()
+	c := make(chan common.DomainRecords)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ParseAndPublishDNSRecords(ctx, reader, c)
+	cancel()
+
+	select {
+	case _, more := <-c:
+		if more {
+			t.Errorf("ParseAndPublishDNSRecords() published records, want channel closed")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("ParseAndPublishDNSRecords() didn't close the channel after cancellation")
+	}
+}
+
+func TestParseAndPublishDNSRecords_malformed(t *testing.T) {
+	t.Parallel()
+
+	input := "a.example.com. A 1.2.3.4\nmalformed\n\nb.example.com. A 5.6.7.8\n"
+	c := make(chan common.DomainRecords)
+
+	errChan := ParseAndPublishDNSRecords(context.Background(), ioutil.NopCloser(strings.NewReader(input)), c)
+
+	count := 0
+	for range c {
+		count++
+	}
+
+	// Malformed line doesn't stop parsing
+	if count != 2 {
+		t.Errorf("ParseAndPublishDNSRecords() published %d records, want %d", count, 2)
+	}
+
+	if err := <-errChan; err == nil {
+		t.Errorf("ParseAndPublishDNSRecords() error = %v, wantErr %v", err, true)
+	}
+}
+
+func TestParseAndPublishDNSRecords_ttl(t *testing.T) {
+	t.Parallel()
+
+	input := "a.example.com. 300 IN CNAME B.example.com\nb.example.com. 60 IN A 1.2.3.4\n\n" +
+		"c.example.com. A 5.6.7.8\n"
+	c := make(chan common.DomainRecords)
+
+	errChan := ParseAndPublishDNSRecords(context.Background(), ioutil.NopCloser(strings.NewReader(input)), c)
+
+	got := make([]common.DomainRecords, 0)
+	for data := range c {
+		got = append(got, data)
+	}
+
+	// Both formats can be mixed
+	want := []common.DomainRecords{
+		{
+			DomainName: "a.example.com.",
+			Records: common.DNSRecordSet{
+				{Name: "a.example.com.", Type: "CNAME", Value: "b.example.com.", TTL: 300},
+				{Name: "b.example.com.", Type: "A", Value: "1.2.3.4", TTL: 60},
+			},
+		},
+		{
+			DomainName: "c.example.com.",
+			Records: common.DNSRecordSet{
+				{Name: "c.example.com.", Type: "A", Value: "5.6.7.8"},
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseAndPublishDNSRecords() = %v, want %v", got, want)
+	}
+
+	if err := <-errChan; err != nil {
+		t.Errorf("ParseAndPublishDNSRecords() error = %v, wantErr %v", err, false)
+	}
+}
+
+func TestParseAndPublishDNSRecords_recordTypes(t *testing.T) {
+	t.Parallel()
+
+	// massdns writes a block for each record type, possibly with other domains in between
+	input := "a.example.com. 300 IN CNAME b.example.com.\nb.example.com. 60 IN A 1.2.3.4\n\n" +
+		"c.example.com. 60 IN A 5.6.7.8\n\n" +
+		"a.example.com. 299 IN CNAME b.example.com.\nb.example.com. 60 IN AAAA 2001:db8::1\n\n"
+	c := make(chan common.DomainRecords)
+
+	errChan := ParseAndPublishDNSRecords(context.Background(), ioutil.NopCloser(strings.NewReader(input)), c)
+
+	got := make([]common.DomainRecords, 0)
+	for data := range c {
+		got = append(got, data)
+	}
+
+	want := []common.DomainRecords{
+		{
+			DomainName: "a.example.com.",
+			Records: common.DNSRecordSet{
+				{Name: "a.example.com.", Type: "CNAME", Value: "b.example.com.", TTL: 300},
+				{Name: "b.example.com.", Type: "A", Value: "1.2.3.4", TTL: 60},
+				{Name: "b.example.com.", Type: "AAAA", Value: "2001:db8::1", TTL: 60},
+			},
+		},
+		{
+			DomainName: "c.example.com.",
+			Records: common.DNSRecordSet{
+				{Name: "c.example.com.", Type: "A", Value: "5.6.7.8", TTL: 60},
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseAndPublishDNSRecords() = %v, want %v", got, want)
+	}
+
+	if err := <-errChan; err != nil {
+		t.Errorf("ParseAndPublishDNSRecords() error = %v, wantErr %v", err, false)
+	}
+}
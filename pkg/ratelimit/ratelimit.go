@@ -0,0 +1,116 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/*
+Limiter limits the rate of events to a fixed number per second. Events are spaced evenly, so
+there are no bursts. A nil Limiter doesn't limit anything. It's safe for concurrent use.
+*/
+type Limiter struct {
+	interval time.Duration
+	next     time.Time
+	mutex    sync.Mutex
+}
+
+/*
+reserve reserves the next slot and returns the duration to wait for it
+*/
+func (l *Limiter) reserve() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+
+	if l.next.Before(now) {
+		l.next = now
+	}
+
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+
+	return wait
+}
+
+/*
+Wait blocks until the next event is allowed or ctx is done. Returns ctx.Err() if ctx is done first,
+the event must not happen in such case.
+*/
+func (l *Limiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(l.reserve())
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+/*
+CreateLimiterInstance returns a newly initialized Limiter allowing `perSecond` events per second.
+Returns nil, i.e. no limit, if perSecond is not positive.
+*/
+func CreateLimiterInstance(perSecond int) *Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+
+	x := new(Limiter)
+	x.interval = time.Second / time.Duration(perSecond)
+	return x
+}
+
+/*
+LimiterGroup holds a separate Limiter for each key, all allowing same rate. A nil LimiterGroup
+doesn't limit anything. It's safe for concurrent use.
+*/
+type LimiterGroup struct {
+	perSecond int
+	limiters  map[string]*Limiter
+	mutex     sync.Mutex
+}
+
+/*
+Get returns the Limiter for the key, creating it if required
+*/
+func (g *LimiterGroup) Get(key string) *Limiter {
+	if g == nil {
+		return nil
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	limiter, ok := g.limiters[key]
+
+	if !ok {
+		limiter = CreateLimiterInstance(g.perSecond)
+		g.limiters[key] = limiter
+	}
+
+	return limiter
+}
+
+/*
+CreateLimiterGroupInstance returns a newly initialized LimiterGroup allowing `perSecond` events per
+second for each key. Returns nil, i.e. no limit, if perSecond is not positive.
+*/
+func CreateLimiterGroupInstance(perSecond int) *LimiterGroup {
+	if perSecond <= 0 {
+		return nil
+	}
+
+	x := new(LimiterGroup)
+	x.perSecond = perSecond
+	x.limiters = map[string]*Limiter{}
+	return x
+}
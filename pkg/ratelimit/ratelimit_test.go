@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Wait(t *testing.T) {
+	t.Run("Events are spaced evenly", func(t *testing.T) {
+		l := CreateLimiterInstance(100)
+
+		start := time.Now()
+		for i := 0; i < 11; i++ {
+			if err := l.Wait(context.Background()); err != nil {
+				t.Errorf("Wait() error = %v, wantErr %v", err, false)
+				return
+			}
+		}
+		elapsed := time.Since(start)
+
+		// First event is immediate, next 10 are 10ms apart
+		if elapsed < 100*time.Millisecond {
+			t.Errorf("Wait() took %v, want at least %v", elapsed, 100*time.Millisecond)
+		}
+	})
+
+	t.Run("No limit", func(t *testing.T) {
+		l := CreateLimiterInstance(0)
+
+		if l != nil {
+			t.Errorf("CreateLimiterInstance() = %v, want %v", l, nil)
+		}
+
+		// Must not block or panic
+		if err := l.Wait(context.Background()); err != nil {
+			t.Errorf("Wait() error = %v, wantErr %v", err, false)
+		}
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		l := CreateLimiterInstance(1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// Takes the only slot of this second
+		if err := l.Wait(ctx); err != nil {
+			t.Errorf("Wait() error = %v, wantErr %v", err, false)
+			return
+		}
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+
+		start := time.Now()
+		err := l.Wait(ctx)
+		elapsed := time.Since(start)
+
+		if err != context.Canceled {
+			t.Errorf("Wait() error = %v, want %v", err, context.Canceled)
+		}
+
+		if elapsed >= 500*time.Millisecond {
+			t.Errorf("Wait() took %v after cancellation, want less than %v", elapsed, 500*time.Millisecond)
+		}
+	})
+}
+
+func TestLimiterGroup_Get(t *testing.T) {
+	g := CreateLimiterGroupInstance(10)
+
+	if g.Get("a") != g.Get("a") {
+		t.Errorf("Get() returned different limiters for same key")
+	}
+
+	if g.Get("a") == g.Get("b") {
+		t.Errorf("Get() returned same limiter for different keys")
+	}
+
+	var nilGroup *LimiterGroup
+	if nilGroup.Get("a") != nil {
+		t.Errorf("Get() on nil group = %v, want %v", nilGroup.Get("a"), nil)
+	}
+}
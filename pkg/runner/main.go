@@ -1,53 +1,194 @@
 package runner
 
 import (
-	"sync"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/faizal3199/dns-wildcard-removal/pkg/backend"
 	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
-	"github.com/faizal3199/dns-wildcard-removal/pkg/logicengine"
-	"github.com/faizal3199/dns-wildcard-removal/pkg/massdns"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/filter"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/logicengine/probecache"
 	"github.com/faizal3199/dns-wildcard-removal/pkg/options"
 	"github.com/faizal3199/dns-wildcard-removal/pkg/output"
 	"github.com/faizal3199/dns-wildcard-removal/pkg/parser"
 )
 
 /*
-worker checks the DomainRecords sent by parser to be wildcard using logic engine
-and then sends it to output channel.
+Exit status codes. Errors before or while running the pipeline exit with 1 through common.FailOnError
 */
-func worker(l *logicengine.LogicEngine,
-	parserChan <-chan common.DomainRecords,
-	outputChan chan<- common.DomainRecords,
-	wg *sync.WaitGroup,
-) {
-	defer wg.Done()
-
-	for {
-		data, more := <-parserChan
-
-		if !more {
-			return
+const (
+	// Run completed but some of the domains couldn't be checked or the backend failed
+	exitCodeFailures = 2
+	// Run was interrupted by a signal
+	exitCodeInterrupted = 130
+)
+
+/*
+createProbeCacheFromOptions returns the probe cache for trusted resolvers and probe config as per args.
+It's bound by args.MaxParents. nil is returned if the cache isn't required.
+*/
+func createProbeCacheFromOptions(args options.Options) (*probecache.ProbeCache, error) {
+	if args.ProbeCache == "" {
+		return nil, nil
+	}
+
+	fingerprint := probecache.Fingerprint(args.TrustedResolver, args.ProbeConfig)
+
+	return probecache.CreateProbeCacheInstance(args.ProbeCache, fingerprint, args.ProbeCacheMaxAge,
+		args.MaxParents)
+}
+
+/*
+createFilterFromOptions returns the Filter configured as per args. probeCache is optional.
+*/
+func createFilterFromOptions(args options.Options, probeCache *probecache.ProbeCache) (*filter.Filter, error) {
+	return filter.CreateFilterInstance(filter.Config{
+		Domains:          args.Domains,
+		AutoDetectDomain: args.AutoDomain,
+		Resolvers:        args.Resolver,
+		TrustedResolvers: args.TrustedResolver,
+		Threads:          args.Threads,
+		Concurrency:      args.Concurrency,
+		QueryConfig:      args.QueryConfig,
+		ProbeConfig:      args.ProbeConfig,
+		ProbeCache:       probeCache,
+		MaxParents:       args.MaxParents,
+	})
+}
+
+/*
+startReportWriter starts writing the results sent on returned channel to path using write. The error
+returned by write is sent on the returned error channel once the results channel is closed. If path
+is empty, nil channel is returned for results.
+*/
+func startReportWriter(path string, format string,
+	write func(string, string, <-chan filter.Result) error) (chan filter.Result, <-chan error) {
+	errChan := make(chan error, 1)
+
+	if path == "" {
+		errChan <- nil
+		return nil, errChan
+	}
+
+	c := output.CreateChannel()
+
+	go func() {
+		err := write(path, format, c)
+
+		// Keep draining so that the pipeline isn't blocked by a failed report
+		for range c {
 		}
 
-		isWildCard, err := l.IsDomainWildCard(data)
+		errChan <- err
+	}()
+
+	return c, errChan
+}
+
+/*
+run initializes all the required components around the provided backend and make each
+component work in sync. f checks the records published by backend. It blocks until the output
+is completely written. If ctx is done, the pipeline is drained, output written until then is
+flushed and ctx.Err() is returned. Domains which couldn't be checked and backend failure are
+reported and counted in the returned number of failures.
+*/
+func run(ctx context.Context, args options.Options, f *filter.Filter, b backend.Backend) (int, error) {
+	// Init channels
+	parserChannel := parser.CreateChannel()
+	outputChannel := output.CreateChannel()
+
+	// Starts backend in background
+	err := b.Start(ctx, parserChannel)
+	if err != nil {
+		return 0, err
+	}
 
-		if err != nil {
-			log.Warningf("Error occurred while fetching wildcard status: %v", err)
-			// don't save such domains to output
-			continue
+	results := f.FilterRecords(ctx, parserChannel)
+	failedCount := 0
+
+	// Reports are written in background
+	removedChannel, removedErrChan := startReportWriter(args.RemovedOutput, args.Format,
+		output.StartWritingRemovedOutput)
+	explainChannel, explainErrChan := startReportWriter(args.Explain, args.Format,
+		output.StartWritingExplainOutput)
+
+	go func() {
+		for result := range results {
+			if explainChannel != nil {
+				explainChannel <- result
+			}
+
+			if result.Err != nil {
+				log.Warningf("Error occurred while fetching wildcard status: %v", result.Err)
+				failedCount++
+				// don't save such domains to output
+				continue
+			}
+
+			if !result.IsWildcard {
+				outputChannel <- result
+			} else if removedChannel != nil {
+				removedChannel <- result
+			}
 		}
 
-		if !isWildCard {
-			outputChan <- data
+		log.Infoln("Closing output channel")
+		if removedChannel != nil {
+			close(removedChannel)
 		}
+		if explainChannel != nil {
+			close(explainChannel)
+		}
+		close(outputChannel)
+	}()
+
+	// Call the blocking function. This wait until outputChannel is closed
+	err = output.StartWritingOutput(args.Output, args.Format, outputChannel)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := <-removedErrChan; err != nil {
+		return 0, err
+	}
+
+	if err := <-explainErrChan; err != nil {
+		return 0, err
 	}
+
+	// Backend is done as outputChannel is closed only after all the records are processed
+	if err := b.Err(); err != nil {
+		log.Errorf("Backend failed: %v", err)
+		failedCount++
+	}
+
+	return failedCount, ctx.Err()
 }
 
 /*
-Start is the heart of the application. It initializes all the required components and
-make each component work in sync.
+cancelOnSignal calls cancel on first interrupt or termination signal. Any further signal is
+handled as per default behaviour i.e. the process is killed.
+*/
+func cancelOnSignal(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+
+		log.Warningf("Received %v, stopping after writing output processed till now", sig)
+		cancel()
+	}()
+}
+
+/*
+Start is the heart of the application. It parses the options, initializes the selected
+backend and runs the pipeline.
 */
 func Start() {
 	log.SetLevel(log.WarnLevel)
@@ -57,38 +198,44 @@ func Start() {
 
 	log.SetLevel(args.LogLevel)
 
-	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	// Init channels
-	parserChannel := parser.CreateChannel()
-	outputChannel := output.CreateChannel()
+	cancelOnSignal(cancel)
 
-	// Init logic engine
-	logicEngine := logicengine.CreateLogicEngineInstance(args.Domain, args.Resolver)
+	probeCache, err := createProbeCacheFromOptions(args)
+	common.FailOnError(err, "Error loading probe cache")
 
-	// Starts massdns process in background
-	massdnsOutputPipe, err := massdns.StartMassdnsProcess(args.Input, args.ResolverFile)
-	common.FailOnError(err, "Error initializing massdns")
+	f, err := createFilterFromOptions(args, probeCache)
+	common.FailOnError(err, "Error initializing filter")
 
-	// Start parser in background
-	parser.ParseAndPublishDNSRecords(massdnsOutputPipe, parserChannel)
+	b, err := backend.CreateBackendFromOptions(args, f.Client())
+	common.FailOnError(err, "Error initializing backend")
 
-	log.Debugf("Initializing %d workers", args.Threads)
-	for i := 0; i < args.Threads; i++ {
-		wg.Add(1)
-		go worker(logicEngine, parserChannel, outputChannel, &wg)
+	failedCount, err := run(ctx, args, f, b)
+
+	if args.Backend == options.BackendNative {
+		log.Infof("Resolver health summary:\n%s", f.Client().Pool().HealthSummary())
 	}
 
-	// Wait for all goroutines to complete. This way any long
-	// processing being done by any thread can be completed
-	go func() {
-		wg.Wait()
+	log.Infof("Wildcard probing resolver health summary:\n%s", f.ProbeClient().Pool().HealthSummary())
 
-		log.Infoln("Closing output channel")
-		close(outputChannel)
-	}()
+	// Results probed till now are saved even if interrupted
+	if probeCache != nil {
+		if err := probeCache.Save(); err != nil {
+			log.Errorf("Error while saving probe cache: %v", err)
+		}
+	}
 
-	// Call the blocking function. This wait until outputChannel is closed
-	err = output.StartWritingOutput(args.Output, outputChannel)
-	common.FailOnError(err, "Error while initializing/writing to output stream")
+	if ctx.Err() != nil {
+		log.Warningln("Interrupted before all the domains were processed. Output is incomplete")
+		os.Exit(exitCodeInterrupted)
+	}
+
+	common.FailOnError(err, "Error while running the pipeline")
+
+	if failedCount > 0 {
+		log.Errorf("Completed with %d failures. Output may be incomplete", failedCount)
+		os.Exit(exitCodeFailures)
+	}
 }
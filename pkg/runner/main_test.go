@@ -0,0 +1,203 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/faizal3199/dns-wildcard-removal/pkg/common"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/dnsengine"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/logicengine/wildcardstruct"
+	"github.com/faizal3199/dns-wildcard-removal/pkg/options"
+)
+
+/*
+fakeBackend publishes the provided records without resolving anything
+*/
+type fakeBackend struct {
+	records []common.DomainRecords
+	err     error
+}
+
+func (b *fakeBackend) Start(ctx context.Context, c chan<- common.DomainRecords) error {
+	go func() {
+		defer close(c)
+
+		for _, record := range b.records {
+			select {
+			case <-ctx.Done():
+				return
+			case c <- record:
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (b *fakeBackend) Err() error {
+	return b.err
+}
+
+func Test_run(t *testing.T) {
+	outputFile, err := ioutil.TempFile("", "rand0m_tmp_*")
+	if err != nil {
+		t.Errorf("run(): Encountered error: %v", err)
+		return
+	}
+	defer os.Remove(outputFile.Name())
+
+	args := options.Options{
+		Domains:     []string{"root-servers.net."},
+		Resolver:    common.DNSServers{"1.1.1.1", "8.8.8.8"},
+		Threads:     2,
+		Concurrency: 1,
+		QueryConfig: dnsengine.DefaultConfig(),
+		ProbeConfig: wildcardstruct.DefaultProbeConfig(),
+		Output:      outputFile.Name(),
+		Format:      options.FormatText,
+	}
+
+	b := &fakeBackend{
+		records: []common.DomainRecords{
+			{
+				DomainName: "a.root-servers.net.",
+				Records: common.DNSRecordSet{
+					{
+						Name:  "a.root-servers.net.",
+						Type:  "A",
+						Value: "198.41.0.4",
+					},
+				},
+			},
+			{
+				// Out-of-scope domains are reported as failure and dropped
+				DomainName: "abc.evil.com.",
+				Records: common.DNSRecordSet{
+					{
+						Name:  "abc.evil.com.",
+						Type:  "A",
+						Value: "0.0.0.0",
+					},
+				},
+			},
+		},
+	}
+
+	f, err := createFilterFromOptions(args, nil)
+	if err != nil {
+		t.Errorf("run(): Encountered error: %v", err)
+		return
+	}
+
+	failedCount, err := run(context.Background(), args, f, b)
+	if err != nil {
+		t.Errorf("run() error = %v, wantErr %v", err, false)
+		return
+	}
+
+	// Out-of-scope domain can't be checked
+	if failedCount != 1 {
+		t.Errorf("run() failures = %d, want %d", failedCount, 1)
+	}
+
+	got, err := ioutil.ReadFile(outputFile.Name())
+	if err != nil {
+		t.Errorf("run(): Encountered error: %v", err)
+		return
+	}
+
+	want := "a.root-servers.net. A 198.41.0.4\n"
+
+	if string(got) != want {
+		t.Errorf("run() output = `%s`, want `%s`", got, want)
+	}
+}
+
+func Test_run_cancelled(t *testing.T) {
+	outputFile, err := ioutil.TempFile("", "rand0m_tmp_*")
+	if err != nil {
+		t.Errorf("run(): Encountered error: %v", err)
+		return
+	}
+	defer os.Remove(outputFile.Name())
+
+	args := options.Options{
+		Domains:     []string{"root-servers.net."},
+		Resolver:    common.DNSServers{"127.0.0.1"},
+		Threads:     2,
+		Concurrency: 1,
+		QueryConfig: dnsengine.DefaultConfig(),
+		ProbeConfig: wildcardstruct.DefaultProbeConfig(),
+		Output:      outputFile.Name(),
+		Format:      options.FormatText,
+	}
+
+	b := &fakeBackend{
+		records: []common.DomainRecords{
+			{
+				DomainName: "a.root-servers.net.",
+				Records: common.DNSRecordSet{
+					{
+						Name:  "a.root-servers.net.",
+						Type:  "A",
+						Value: "198.41.0.4",
+					},
+				},
+			},
+		},
+	}
+
+	f, err := createFilterFromOptions(args, nil)
+	if err != nil {
+		t.Errorf("run(): Encountered error: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = run(ctx, args, f, b)
+	if err != context.Canceled {
+		t.Errorf("run() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func Test_run_backendFailure(t *testing.T) {
+	outputFile, err := ioutil.TempFile("", "rand0m_tmp_*")
+	if err != nil {
+		t.Errorf("run(): Encountered error: %v", err)
+		return
+	}
+	defer os.Remove(outputFile.Name())
+
+	args := options.Options{
+		Domains:     []string{"root-servers.net."},
+		Resolver:    common.DNSServers{"127.0.0.1"},
+		Threads:     2,
+		Concurrency: 1,
+		QueryConfig: dnsengine.DefaultConfig(),
+		ProbeConfig: wildcardstruct.DefaultProbeConfig(),
+		Output:      outputFile.Name(),
+		Format:      options.FormatText,
+	}
+
+	b := &fakeBackend{err: fmt.Errorf("massdns exited ungracefully")}
+
+	f, err := createFilterFromOptions(args, nil)
+	if err != nil {
+		t.Errorf("run(): Encountered error: %v", err)
+		return
+	}
+
+	failedCount, err := run(context.Background(), args, f, b)
+	if err != nil {
+		t.Errorf("run() error = %v, wantErr %v", err, false)
+	}
+
+	if failedCount != 1 {
+		t.Errorf("run() failures = %d, want %d", failedCount, 1)
+	}
+}